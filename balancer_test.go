@@ -0,0 +1,135 @@
+package forward
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func balanceNames(t *testing.T, b *Balancer, req *http.Request, n int) []string {
+	var names []string
+	for i := 0; i < n; i++ {
+		u, err := b.Next(req)
+		st.Expect(t, err, nil)
+		names = append(names, u.URL.Host)
+	}
+	return names
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b, err := NewBalancer(RoundRobin(), "http://a", "http://b", "http://c")
+	st.Expect(t, err, nil)
+	req, _ := http.NewRequest("GET", "http://foo", nil)
+	st.Expect(t, balanceNames(t, b, req, 4), []string{"a", "b", "c", "a"})
+}
+
+func TestBalancerWeightedRoundRobin(t *testing.T) {
+	b, err := NewBalancer(WeightedRoundRobin())
+	st.Expect(t, err, nil)
+	st.Expect(t, b.Add("http://a", 5), nil)
+	st.Expect(t, b.Add("http://b", 1), nil)
+	st.Expect(t, b.Add("http://c", 1), nil)
+	req, _ := http.NewRequest("GET", "http://foo", nil)
+	st.Expect(t, balanceNames(t, b, req, 7), []string{"a", "a", "b", "a", "c", "a", "a"})
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b, err := NewBalancer(LeastConnections(), "http://a", "http://b")
+	st.Expect(t, err, nil)
+	req, _ := http.NewRequest("GET", "http://foo", nil)
+
+	b.Upstreams()[0].acquire()
+	st.Expect(t, balanceNames(t, b, req, 2), []string{"b", "b"})
+	b.Upstreams()[1].acquire()
+	b.Upstreams()[1].acquire()
+	st.Expect(t, balanceNames(t, b, req, 1), []string{"a"})
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	b, err := NewBalancer(ConsistentHash("X-User"), "http://a", "http://b", "http://c")
+	st.Expect(t, err, nil)
+
+	hosts := map[string]string{}
+	for _, user := range []string{"foo", "bar", "baz", "qux", "quux"} {
+		req, _ := http.NewRequest("GET", "http://foo", nil)
+		req.Header.Set("X-User", user)
+		names := balanceNames(t, b, req, 3)
+		st.Expect(t, names[0], names[1])
+		st.Expect(t, names[1], names[2])
+		hosts[user] = names[0]
+	}
+
+	// Removing an upstream server only remaps its own keys
+	st.Expect(t, b.Remove("http://c"), nil)
+	for user, host := range hosts {
+		req, _ := http.NewRequest("GET", "http://foo", nil)
+		req.Header.Set("X-User", user)
+		if host != "c" {
+			st.Expect(t, balanceNames(t, b, req, 1)[0], host)
+		}
+	}
+}
+
+func TestBalancerAddRemove(t *testing.T) {
+	b, err := NewBalancer(nil)
+	st.Expect(t, err, nil)
+
+	req, _ := http.NewRequest("GET", "http://foo", nil)
+	_, err = b.Next(req)
+	st.Expect(t, err, ErrNoUpstream)
+
+	st.Expect(t, b.Add("http://a", 1), nil)
+	st.Expect(t, b.Add("http://a", 3), nil)
+	st.Expect(t, len(b.Upstreams()), 1)
+	st.Expect(t, b.Upstreams()[0].Weight(), 3)
+	st.Expect(t, b.Remove("http://a"), nil)
+	st.Expect(t, b.Remove("http://a"), ErrUpstreamNotFound)
+	st.Expect(t, len(b.Upstreams()), 0)
+}
+
+func TestForwardBalancer(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			w.Write([]byte(name))
+		}
+	}
+	srv1 := testutils.NewHandler(handler("foo"))
+	defer srv1.Close()
+	srv2 := testutils.NewHandler(handler("bar"))
+	defer srv2.Close()
+
+	b, err := NewBalancer(RoundRobin(), srv1.URL)
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(ToMany(b))
+	defer proxy.Close()
+
+	_, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(body), "foo")
+
+	// Upstream servers can be changed without rebuilding the handler
+	st.Expect(t, b.Add(srv2.URL, 1), nil)
+	for i := 0; i < 4; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		st.Expect(t, err, nil)
+		st.Expect(t, re.StatusCode, http.StatusOK)
+	}
+	st.Expect(t, hits["foo"], 3)
+	st.Expect(t, hits["bar"], 2)
+	st.Expect(t, b.Upstreams()[0].Conns(), int64(0))
+
+	st.Expect(t, b.Remove(srv1.URL), nil)
+	st.Expect(t, b.Remove(srv2.URL), nil)
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,238 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+
+	"gopkg.in/vinxi/utils.v0"
+)
+
+// DefaultMemoryBytes stores the default maximum response body size
+// kept in memory by the buffered forwarding mode.
+var DefaultMemoryBytes int64 = 1 << 20
+
+// BufferOptions defines the buffered forwarding mode options.
+type BufferOptions struct {
+	// MemoryBytes defines the maximum response body size kept in memory
+	// before spilling it to a temporary file. Defaults to DefaultMemoryBytes.
+	MemoryBytes int64
+	// TempDir defines the directory used to store the temporary files.
+	// Defaults to the system temporary directory.
+	TempDir string
+	// Hook defines an optional hook called with every buffered response
+	// before anything is written to the client.
+	Hook ResponseHook
+}
+
+// BufferedResponse represents a fully read upstream response,
+// which can be inspected and rewritten before being written to the client.
+type BufferedResponse struct {
+	// StatusCode stores the response status code.
+	StatusCode int
+	// Header stores the response headers.
+	Header http.Header
+	// Trailer stores the response trailers.
+	Trailer http.Header
+	// Body stores the response body.
+	Body *Buffer
+}
+
+// ResponseHook can inspect and rewrite buffered upstream responses.
+type ResponseHook interface {
+	// HandleResponse is called with the buffered upstream response.
+	// Returning an error replies to the client using the error handler.
+	HandleResponse(req *http.Request, res *BufferedResponse) error
+}
+
+// ResponseHookFunc is an adapter to use ordinary functions as ResponseHook.
+type ResponseHookFunc func(req *http.Request, res *BufferedResponse) error
+
+// HandleResponse calls f(req, res).
+func (f ResponseHookFunc) HandleResponse(req *http.Request, res *BufferedResponse) error {
+	return f(req, res)
+}
+
+// Buffer stores data in memory up to a threshold, spilling it to a temporary file
+// once exceeded. Reading the buffer does not consume the data: use Rewind
+// to read it again from the beginning.
+type Buffer struct {
+	max    int64
+	dir    string
+	mem    bytes.Buffer
+	file   *os.File
+	size   int64
+	offset int64
+}
+
+// newBuffer creates a new buffer keeping up to max bytes in memory.
+func newBuffer(max int64, dir string) *Buffer {
+	return &Buffer{max: max, dir: dir}
+}
+
+// Write appends the given data to the buffer.
+func (b *Buffer) Write(p []byte) (int, error) {
+	if b.file == nil && int64(b.mem.Len()+len(p)) > b.max {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.WriteAt(p, b.size)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// spill moves the data kept in memory to a temporary file.
+func (b *Buffer) spill() error {
+	file, err := ioutil.TempFile(b.dir, "forward")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b.mem.Bytes()); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	b.file = file
+	b.mem.Reset()
+	return nil
+}
+
+// Read reads the buffered data.
+func (b *Buffer) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.file != nil {
+		if remaining := b.size - b.offset; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		n, err := b.file.ReadAt(p, b.offset)
+		b.offset += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	n := copy(p, b.mem.Bytes()[b.offset:])
+	b.offset += int64(n)
+	return n, nil
+}
+
+// Rewind moves the read position back to the beginning of the buffered data.
+func (b *Buffer) Rewind() {
+	b.offset = 0
+}
+
+// Len returns the size of the buffered data.
+func (b *Buffer) Len() int64 {
+	return b.size
+}
+
+// Spilled returns true if the buffered data is stored in a temporary file.
+func (b *Buffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Bytes returns the buffered data, reading it from the temporary file if needed.
+func (b *Buffer) Bytes() ([]byte, error) {
+	if b.file == nil {
+		return b.mem.Bytes(), nil
+	}
+	data := make([]byte, b.size)
+	_, err := b.file.ReadAt(data, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return data, err
+}
+
+// Reset discards the buffered data.
+func (b *Buffer) Reset() {
+	b.Close()
+	b.mem.Reset()
+	b.size = 0
+	b.offset = 0
+}
+
+// SetBytes replaces the buffered data with the given data.
+func (b *Buffer) SetBytes(data []byte) error {
+	b.Reset()
+	_, err := b.Write(data)
+	return err
+}
+
+// Close removes the temporary file, if any.
+func (b *Buffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	os.Remove(b.file.Name())
+	b.file = nil
+	return err
+}
+
+// serveBuffered reads the whole upstream response before writing it to the client,
+// calling the buffered response hook, if any.
+func (f *httpForwarder) serveBuffered(w http.ResponseWriter, req *http.Request, response *http.Response, addr string, ctx *handlerContext) {
+	body := newBuffer(f.buffer.MemoryBytes, f.buffer.TempDir)
+	defer body.Close()
+
+	if _, err := io.Copy(body, response.Body); err != nil {
+		if req.Context().Err() != nil {
+			ctx.log.Infof("Client cancelled request to %v while buffering the response body", req.URL)
+			return
+		}
+		err = newError(PhaseCopyBody, addr, err)
+		ctx.log.Errorf("Error buffering upstream response Body: %v", err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	res := &BufferedResponse{
+		StatusCode: response.StatusCode,
+		Header:     make(http.Header),
+		Trailer:    make(http.Header),
+		Body:       body,
+	}
+	utils.CopyHeaders(res.Header, response.Header)
+	utils.CopyHeaders(res.Trailer, response.Trailer)
+
+	if f.buffer.Hook != nil {
+		if err := f.buffer.Hook.HandleResponse(req, res); err != nil {
+			ctx.log.Errorf("Error handling buffered response to %v: %v", req.URL, err)
+			ctx.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+	}
+
+	utils.CopyHeaders(w.Header(), res.Header)
+	// the body may have been rewritten, while HEAD responses keep the upstream length.
+	// Trailers require a response of unknown length.
+	if req.Method != "HEAD" {
+		w.Header().Del(ContentLength)
+		if len(res.Trailer) == 0 && bodyAllowedForStatus(res.StatusCode) {
+			w.Header().Set(ContentLength, strconv.FormatInt(res.Body.Len(), 10))
+		}
+	}
+	announced := announceTrailers(w.Header(), res.Trailer)
+	w.WriteHeader(res.StatusCode)
+
+	res.Body.Rewind()
+	if _, err := io.Copy(w, res.Body); err != nil {
+		ctx.log.Errorf("Error writing buffered response Body: %v", err)
+		return
+	}
+	copyTrailers(w.Header(), res.Trailer, announced)
+}
@@ -0,0 +1,144 @@
+package forward
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestBufferSpill(t *testing.T) {
+	b := newBuffer(4, "")
+	b.Write([]byte("hel"))
+	st.Expect(t, b.Spilled(), false)
+	b.Write([]byte("lo"))
+	st.Expect(t, b.Spilled(), true)
+	name := b.file.Name()
+
+	data, err := ioutil.ReadAll(b)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(data), "hello")
+	st.Expect(t, b.Len(), int64(5))
+
+	b.Rewind()
+	data, _ = ioutil.ReadAll(b)
+	st.Expect(t, string(data), "hello")
+
+	st.Expect(t, b.SetBytes([]byte("bye")), nil)
+	_, err = os.Stat(name)
+	st.Expect(t, os.IsNotExist(err), true)
+	data, _ = b.Bytes()
+	st.Expect(t, string(data), "bye")
+	st.Expect(t, b.Close(), nil)
+}
+
+func TestBufferingHook(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("stack trace"))
+	})
+	defer srv.Close()
+
+	hook := ResponseHookFunc(func(req *http.Request, res *BufferedResponse) error {
+		body, _ := res.Body.Bytes()
+		st.Expect(t, string(body), "stack trace")
+		res.StatusCode = http.StatusServiceUnavailable
+		res.Header.Set("Retry-After", "10")
+		return res.Body.SetBytes([]byte("try again later"))
+	})
+	proxy := newTestProxy(t, srv.URL, Buffering(BufferOptions{Hook: hook}))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusServiceUnavailable)
+	st.Expect(t, re.Header.Get("Retry-After"), "10")
+	st.Expect(t, re.ContentLength, int64(15))
+	st.Expect(t, string(body), "try again later")
+}
+
+func TestBufferingSpilledResponse(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 10000)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		// sent as chunked response
+		w.Write(data[:5000])
+		w.(http.Flusher).Flush()
+		w.Write(data[5000:])
+	})
+	defer srv.Close()
+
+	spilled := false
+	hook := ResponseHookFunc(func(req *http.Request, res *BufferedResponse) error {
+		spilled = res.Body.Spilled()
+		return nil
+	})
+	proxy := newTestProxy(t, srv.URL, Buffering(BufferOptions{MemoryBytes: 1024, Hook: hook}))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, spilled, true)
+	st.Expect(t, re.ContentLength, int64(10000))
+	st.Expect(t, bytes.Equal(body, data), true)
+}
+
+func TestBufferingHookError(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	hook := ResponseHookFunc(func(req *http.Request, res *BufferedResponse) error {
+		return errors.New("invalid response")
+	})
+	proxy := newTestProxy(t, srv.URL, Buffering(BufferOptions{Hook: hook}))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusBadGateway)
+}
+
+func TestBufferingMaxResponseBytes(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(" world"))
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL, Buffering(BufferOptions{}), MaxResponseBytes(10))
+	defer proxy.Close()
+
+	// the response is not sent yet, so the error can be reported
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusBadGateway)
+}
+
+func TestBufferingSkipsStreams(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: hello\n\n"))
+	})
+	defer srv.Close()
+
+	called := false
+	hook := ResponseHookFunc(func(req *http.Request, res *BufferedResponse) error {
+		called = true
+		return nil
+	})
+	proxy := newTestProxy(t, srv.URL, Buffering(BufferOptions{Hook: hook}))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, string(body), "data: hello\n\n")
+	st.Expect(t, called, false)
+}
@@ -0,0 +1,351 @@
+// Package compress implements a response compression middleware
+// negotiating the content encoding via the Accept-Encoding header.
+//
+// Responses are compressed while they are streamed, flushing the compressed
+// data whenever the response is flushed, such as by the forward package.
+package compress
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultMinSize stores the default minimum size of the responses of known length to compress.
+var DefaultMinSize int64 = 1024
+
+// DefaultPreference stores the default server preference of the content encodings,
+// used when the client accepts several encodings with the same quality.
+var DefaultPreference = []string{"br", "gzip", "deflate"}
+
+// DefaultSkipTypes stores the default media types which are never compressed,
+// since they are already compressed.
+var DefaultSkipTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"video/*",
+	"audio/*",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+}
+
+// Writer represents a compressing writer.
+type Writer interface {
+	io.WriteCloser
+	// Flush writes any pending compressed data.
+	Flush() error
+}
+
+// Encoder creates compressing writers for a content encoding,
+// using the given compression level.
+type Encoder func(w io.Writer, level int) (Writer, error)
+
+// Encoders stores the built-in content encoders.
+var Encoders = map[string]Encoder{
+	"br": func(w io.Writer, level int) (Writer, error) {
+		return brotli.NewWriterLevel(w, brotliLevel(level)), nil
+	},
+	"gzip": func(w io.Writer, level int) (Writer, error) {
+		return gzip.NewWriterLevel(w, level)
+	},
+	"deflate": func(w io.Writer, level int) (Writer, error) {
+		return zlib.NewWriterLevel(w, level)
+	},
+}
+
+// Options defines the compression options.
+type Options struct {
+	// Level defines the compression level passed to the encoders,
+	// from 1 (best speed) to 9 (best compression). Zero uses the default compression level.
+	// Brotli uses the level as its quality, using its default quality for the default level.
+	Level int
+	// MinSize defines the minimum size of the responses of known length to compress.
+	// Defaults to DefaultMinSize. Use a negative value to compress any response.
+	MinSize int64
+	// SkipTypes defines the media types which are never compressed,
+	// such as "image/png" or "video/*". Defaults to DefaultSkipTypes.
+	SkipTypes []string
+	// Encoders defines additional content encoders, such as zstd,
+	// replacing the built-in ones with the same name.
+	// Additional encoders must be listed in Preference to be negotiated.
+	Encoders map[string]Encoder
+	// Preference defines the server preference of the content encodings.
+	// Defaults to DefaultPreference. Encodings without encoder are ignored.
+	Preference []string
+}
+
+// compressor stores the compression options with the defaults applied.
+type compressor struct {
+	level      int
+	minSize    int64
+	skipTypes  []string
+	encoders   map[string]Encoder
+	preference []string
+}
+
+// New returns a middleware compressing the responses using the given options.
+func New(opts Options) func(http.Handler) http.Handler {
+	c := &compressor{
+		level:      opts.Level,
+		minSize:    opts.MinSize,
+		skipTypes:  opts.SkipTypes,
+		encoders:   make(map[string]Encoder),
+		preference: opts.Preference,
+	}
+	if c.level == 0 {
+		c.level = flate.DefaultCompression
+	}
+	if c.minSize == 0 {
+		c.minSize = DefaultMinSize
+	}
+	if c.skipTypes == nil {
+		c.skipTypes = DefaultSkipTypes
+	}
+	if c.preference == nil {
+		c.preference = DefaultPreference
+	}
+	for name, encoder := range Encoders {
+		c.encoders[name] = encoder
+	}
+	for name, encoder := range opts.Encoders {
+		c.encoders[strings.ToLower(name)] = encoder
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// protocol upgrades, such as websockets, are never compressed
+			if req.Header.Get("Upgrade") != "" {
+				h.ServeHTTP(w, req)
+				return
+			}
+			cw := &responseWriter{ResponseWriter: w, c: c, req: req}
+			h.ServeHTTP(cw, req)
+			// not deferred, so aborted responses are not completed
+			cw.close()
+		})
+	}
+}
+
+// Compress returns a middleware compressing the responses using the default options.
+func Compress(h http.Handler) http.Handler {
+	return New(Options{})(h)
+}
+
+// negotiate returns the preferred content encoding accepted by the given request,
+// or an empty string if none is accepted.
+func (c *compressor) negotiate(req *http.Request) string {
+	accepted := make(map[string]float64)
+	for _, value := range req.Header["Accept-Encoding"] {
+		for _, token := range strings.Split(value, ",") {
+			params := strings.Split(token, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name == "x-gzip" {
+				name = "gzip"
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+			if name != "" {
+				accepted[name] = q
+			}
+		}
+	}
+
+	encoding, best := "", 0.0
+	for _, name := range c.preference {
+		if c.encoders[name] == nil {
+			continue
+		}
+		q, ok := accepted[name]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > best {
+			encoding, best = name, q
+		}
+	}
+	return encoding
+}
+
+// compressible returns true if the response with the given status code and headers
+// can be compressed, regardless of the encodings accepted by the client.
+func (c *compressor) compressible(req *http.Request, code int, h http.Header) bool {
+	if req.Method == "HEAD" || code < 200 || code == http.StatusNoContent ||
+		code == http.StatusNotModified || code == http.StatusPartialContent {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if hasToken(h, "Cache-Control", "no-transform") {
+		return false
+	}
+	if length := h.Get("Content-Length"); length != "" {
+		if n, err := strconv.ParseInt(length, 10, 64); err == nil && n < c.minSize {
+			return false
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	for _, pattern := range c.skipTypes {
+		if pattern == mediaType || strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// responseWriter compresses the response body, deciding whether to compress it
+// once the response headers are about to be sent.
+type responseWriter struct {
+	http.ResponseWriter
+	c         *compressor
+	req       *http.Request
+	code      int
+	committed bool
+	hijacked  bool
+	encoder   Writer
+}
+
+// WriteHeader records the status code, which is sent with the first write or flush,
+// so the body can be sniffed when the content type is unknown.
+func (w *responseWriter) WriteHeader(code int) {
+	if w.committed || w.code != 0 {
+		return
+	}
+	// informational responses are sent as they are
+	if code >= 100 && code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.code = code
+}
+
+// Write writes the compressed data.
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.committed {
+		// empty writes do not send the headers, so empty responses are not compressed
+		if len(p) == 0 {
+			return 0, nil
+		}
+		if _, ok := w.Header()["Content-Type"]; !ok {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.commit(true)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush writes the pending compressed data and flushes the response.
+func (w *responseWriter) Flush() {
+	if !w.committed {
+		w.commit(true)
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("compress: response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// commit sends the response headers, setting up the encoder if the response is compressed.
+func (w *responseWriter) commit(body bool) {
+	w.committed = true
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	h := w.Header()
+	if body && w.c.compressible(w.req, w.code, h) {
+		if !hasToken(h, "Vary", "Accept-Encoding") {
+			h.Add("Vary", "Accept-Encoding")
+		}
+		if encoding := w.c.negotiate(w.req); encoding != "" {
+			if encoder, err := w.c.encoders[encoding](w.ResponseWriter, w.c.level); err == nil {
+				w.encoder = encoder
+				h.Set("Content-Encoding", encoding)
+				h.Del("Content-Length")
+				h.Del("Accept-Ranges")
+				if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+					h.Set("Etag", "W/"+etag)
+				}
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+// close sends the response headers if not sent yet, and writes the remaining compressed data.
+// Empty responses are never compressed.
+func (w *responseWriter) close() {
+	if w.hijacked {
+		return
+	}
+	if !w.committed {
+		w.commit(false)
+	}
+	if w.encoder != nil {
+		w.encoder.Close()
+	}
+}
+
+// brotliLevel returns the brotli quality for the given compression level.
+func brotliLevel(level int) int {
+	if level < brotli.BestSpeed || level > brotli.BestCompression {
+		return brotli.DefaultCompression
+	}
+	return level
+}
+
+// hasToken returns true if the given header contains the given token, compared case-insensitively.
+func hasToken(h http.Header, key, token string) bool {
+	for _, value := range h[key] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/nbio/st"
+	"gopkg.in/vinxi/forward.v0"
+)
+
+var body = strings.Repeat(`{"message":"hello world"}`, 100)
+
+func handler(header http.Header, data string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.Write([]byte(data))
+	})
+}
+
+func request(h http.Handler, method, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestCompressGzip(t *testing.T) {
+	h := Compress(handler(http.Header{"Content-Type": {"application/json"}, "Etag": {`"123"`}}, body))
+	w := request(h, "GET", "gzip, deflate")
+	st.Expect(t, w.Code, http.StatusOK)
+	st.Expect(t, w.Header().Get("Content-Encoding"), "gzip")
+	st.Expect(t, w.Header().Get("Content-Length"), "")
+	st.Expect(t, w.Header().Get("Vary"), "Accept-Encoding")
+	st.Expect(t, w.Header().Get("Etag"), `W/"123"`)
+
+	gz, err := gzip.NewReader(w.Body)
+	st.Expect(t, err, nil)
+	data, err := ioutil.ReadAll(gz)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(data), body)
+}
+
+func TestCompressDeflate(t *testing.T) {
+	w := request(Compress(handler(nil, body)), "GET", "deflate")
+	st.Expect(t, w.Header().Get("Content-Encoding"), "deflate")
+	st.Expect(t, w.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+
+	zr, err := zlib.NewReader(w.Body)
+	st.Expect(t, err, nil)
+	data, _ := ioutil.ReadAll(zr)
+	st.Expect(t, string(data), body)
+}
+
+func TestCompressBrotli(t *testing.T) {
+	w := request(Compress(handler(nil, body)), "GET", "gzip, deflate, br")
+	st.Expect(t, w.Header().Get("Content-Encoding"), "br")
+
+	data, err := ioutil.ReadAll(brotli.NewReader(w.Body))
+	st.Expect(t, err, nil)
+	st.Expect(t, string(data), body)
+}
+
+func TestNegotiate(t *testing.T) {
+	zstd := func(w io.Writer, level int) (Writer, error) {
+		return gzip.NewWriterLevel(w, level)
+	}
+	cases := []struct {
+		encoders       map[string]Encoder
+		preference     []string
+		acceptEncoding string
+		expected       string
+	}{
+		{nil, nil, "", ""},
+		{nil, nil, "identity", ""},
+		{nil, nil, "br", "br"},
+		{nil, nil, "gzip;q=0.5, deflate", "deflate"},
+		{nil, nil, "deflate, gzip", "gzip"},
+		{nil, nil, "x-gzip", "gzip"},
+		{nil, nil, "*", "br"},
+		{nil, nil, "br;q=0, *", "gzip"},
+		{nil, nil, "gzip, br;q=0.9", "gzip"},
+		{nil, []string{"gzip", "br"}, "gzip, br", "gzip"},
+		{nil, nil, "zstd", ""},
+		{map[string]Encoder{"zstd": zstd}, nil, "gzip, zstd", "gzip"},
+		{map[string]Encoder{"zstd": zstd}, []string{"zstd", "gzip"}, "gzip, zstd", "zstd"},
+	}
+	for _, c := range cases {
+		h := New(Options{Encoders: c.encoders, Preference: c.preference})(handler(nil, body))
+		w := request(h, "GET", c.acceptEncoding)
+		st.Expect(t, w.Header().Get("Content-Encoding"), c.expected)
+	}
+}
+
+func TestCompressSkipped(t *testing.T) {
+	cases := []struct {
+		method string
+		header http.Header
+		data   string
+		vary   string
+	}{
+		{"GET", http.Header{"Cache-Control": {"public, no-transform"}}, body, ""},
+		{"GET", http.Header{"Content-Type": {"image/png"}}, body, ""},
+		{"GET", http.Header{"Content-Type": {"video/mp4"}}, body, ""},
+		{"GET", http.Header{"Content-Length": {"5"}}, "hello", ""},
+		{"GET", http.Header{"Content-Encoding": {"br"}}, body, ""},
+		{"GET", nil, "", ""},
+		{"HEAD", nil, body, ""},
+	}
+	for _, c := range cases {
+		w := request(Compress(handler(c.header, c.data)), c.method, "gzip")
+		st.Expect(t, w.Header().Get("Content-Encoding"), c.header.Get("Content-Encoding"))
+		st.Expect(t, w.Header().Get("Vary"), c.vary)
+		if c.method == "GET" {
+			st.Expect(t, w.Body.String(), c.data)
+		}
+	}
+
+	// responses are not compressed if the client does not accept it
+	w := request(Compress(handler(nil, body)), "GET", "")
+	st.Expect(t, w.Header().Get("Content-Encoding"), "")
+	st.Expect(t, w.Header().Get("Vary"), "Accept-Encoding")
+	st.Expect(t, w.Body.String(), body)
+}
+
+func TestCompressStreaming(t *testing.T) {
+	next := make(chan bool)
+	srv := httptest.NewServer(Compress(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("data: second\n\n"))
+	})))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	st.Expect(t, err, nil)
+	defer res.Body.Close()
+	st.Expect(t, res.Header.Get("Content-Encoding"), "gzip")
+
+	// the first event is received before the handler writes the second one
+	gz, err := gzip.NewReader(res.Body)
+	st.Expect(t, err, nil)
+	event := make([]byte, 13)
+	_, err = io.ReadFull(gz, event)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(event), "data: first\n\n")
+
+	close(next)
+	rest, err := ioutil.ReadAll(gz)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(rest), "data: second\n\n")
+}
+
+func TestCompressForwarder(t *testing.T) {
+	upstream := httptest.NewServer(handler(http.Header{"Content-Type": {"application/json"}}, body))
+	defer upstream.Close()
+
+	srv := httptest.NewServer(Compress(http.HandlerFunc(forward.To(upstream.URL))))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	st.Expect(t, err, nil)
+	defer res.Body.Close()
+	st.Expect(t, res.StatusCode, http.StatusOK)
+	st.Expect(t, res.Header.Get("Content-Encoding"), "gzip")
+	st.Expect(t, res.ContentLength, int64(-1))
+
+	data, _ := ioutil.ReadAll(res.Body)
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	st.Expect(t, err, nil)
+	data, _ = ioutil.ReadAll(gz)
+	st.Expect(t, string(data), body)
+}
@@ -0,0 +1,4 @@
+package compress
+
+// Version stores the current package semantic version.
+const Version = "0.1.0"
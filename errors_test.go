@@ -0,0 +1,98 @@
+package forward
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+	"gopkg.in/vinxi/utils.v0"
+)
+
+func TestStatusHandlerStatusCode(t *testing.T) {
+	h := &StatusHandler{}
+	st.Expect(t, h.StatusCode(errors.New("foo")), http.StatusBadGateway)
+	st.Expect(t, h.StatusCode(newError(PhaseDial, "localhost:80", errors.New("refused"))), http.StatusServiceUnavailable)
+	st.Expect(t, h.StatusCode(newError(PhaseReadHeaders, "localhost:80", errors.New("EOF"))), http.StatusBadGateway)
+	st.Expect(t, h.StatusCode(newError(PhaseReadHeaders, "localhost:80", &timeoutError{"timeout"})), http.StatusGatewayTimeout)
+	st.Expect(t, h.StatusCode(ErrUnsupportedEncoding), http.StatusUnsupportedMediaType)
+	st.Expect(t, h.StatusCode(ErrInvalidRequestBody), http.StatusBadRequest)
+}
+
+func TestStatusHandlerJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := newError(PhaseReadHeaders, "10.0.0.1:80", &timeoutError{"timeout"})
+	(&StatusHandler{JSON: true}).ServeHTTP(w, &http.Request{}, err)
+
+	var body map[string]interface{}
+	st.Expect(t, json.Unmarshal(w.Body.Bytes(), &body), nil)
+	st.Expect(t, w.Code, http.StatusGatewayTimeout)
+	st.Expect(t, w.Header().Get("Content-Type"), "application/json")
+	st.Expect(t, body["phase"], "read_headers")
+	st.Expect(t, body["timeout"], true)
+	st.Expect(t, body["status"], float64(http.StatusGatewayTimeout))
+}
+
+func TestForwardErrorPhase(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	st.Expect(t, err, nil)
+	addr := l.Addr().String()
+	l.Close()
+
+	var fwdErr error
+	f, err := New(ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		fwdErr = err
+		DefaultErrorHandler.ServeHTTP(w, req, err)
+	})))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://" + addr)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusServiceUnavailable)
+
+	e, ok := fwdErr.(*Error)
+	st.Expect(t, ok, true)
+	st.Expect(t, e.Phase, PhaseDial)
+	st.Expect(t, e.Addr, addr)
+	st.Expect(t, e.Timeout(), false)
+}
+
+func TestForwardErrorReadHeaders(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	defer srv.Close()
+
+	var fwdErr error
+	f, err := New(ResponseHeaderTimeout(20*time.Millisecond), ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		fwdErr = err
+		DefaultErrorHandler.ServeHTTP(w, req, err)
+	})))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusGatewayTimeout)
+
+	e, ok := fwdErr.(*Error)
+	st.Expect(t, ok, true)
+	st.Expect(t, e.Phase, PhaseReadHeaders)
+	st.Expect(t, e.Timeout(), true)
+}
@@ -0,0 +1,91 @@
+package forward
+
+import (
+	"bufio"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestFlushIntervalDetection(t *testing.T) {
+	res := &http.Response{Header: http.Header{}, ContentLength: 10}
+	st.Expect(t, flushInterval(res, 0), time.Duration(0))
+	st.Expect(t, flushInterval(res, time.Second), time.Second)
+
+	res.Header.Set("Content-Type", "text/event-stream; charset=utf-8")
+	st.Expect(t, flushInterval(res, time.Second), FlushImmediately)
+
+	res = &http.Response{Header: http.Header{}, ContentLength: -1}
+	st.Expect(t, flushInterval(res, 0), FlushImmediately)
+}
+
+func TestForwardStreamingResponse(t *testing.T) {
+	release := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: foo\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("data: bar\n\n"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	defer res.Body.Close()
+
+	// The first event must reach the client while the upstream is still blocked
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	close(release)
+	st.Expect(t, err, nil)
+	st.Expect(t, line, "data: foo\n")
+}
+
+func TestForwardFlushInterval(t *testing.T) {
+	release := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "6")
+		w.Write([]byte("foo"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("bar"))
+	})
+	defer srv.Close()
+
+	f, err := New(FlushInterval(10 * time.Millisecond))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	defer res.Body.Close()
+
+	buf := make([]byte, 3)
+	_, err = res.Body.Read(buf)
+	close(release)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(buf), "foo")
+}
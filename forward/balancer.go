@@ -0,0 +1,358 @@
+package forward
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/vinxi/utils.v0"
+)
+
+var (
+	// ErrNoUpstream is returned when there is no upstream server available.
+	ErrNoUpstream = errors.New("forward: no upstream server available")
+	// ErrUpstreamNotFound is returned when removing an unknown upstream server.
+	ErrUpstreamNotFound = errors.New("forward: upstream server not found")
+)
+
+// Upstream represents an upstream server balanced by a Balancer.
+type Upstream struct {
+	// URL stores the upstream server URL.
+	URL *url.URL
+	// weight stores the upstream weight used by weighted strategies.
+	weight int64
+	// conns stores the number of in-flight requests.
+	conns int64
+	// health stores the upstream health state.
+	health upstreamHealth
+}
+
+// Weight returns the upstream weight used by weighted strategies.
+func (u *Upstream) Weight() int {
+	return int(atomic.LoadInt64(&u.weight))
+}
+
+// Conns returns the number of in-flight requests to the upstream server.
+func (u *Upstream) Conns() int64 {
+	return atomic.LoadInt64(&u.conns)
+}
+
+// acquire increments the in-flight requests counter.
+func (u *Upstream) acquire() {
+	atomic.AddInt64(&u.conns, 1)
+}
+
+// release decrements the in-flight requests counter.
+func (u *Upstream) release() {
+	atomic.AddInt64(&u.conns, -1)
+}
+
+// Strategy selects the upstream server used to forward the given request.
+type Strategy interface {
+	Next(req *http.Request, upstreams []*Upstream) *Upstream
+}
+
+// Balancer balances the outgoing traffic across a pool of upstream servers
+// based on the given strategy.
+// Upstream servers can be safely added or removed at runtime.
+type Balancer struct {
+	mu        sync.RWMutex
+	strategy  Strategy
+	upstreams []*Upstream
+	checker   *HealthChecker
+}
+
+// NewBalancer creates a new balancer with the given strategy and upstream server URLs.
+// Round robin strategy is used if no strategy is given.
+func NewBalancer(strategy Strategy, uris ...string) (*Balancer, error) {
+	if strategy == nil {
+		strategy = RoundRobin()
+	}
+	b := &Balancer{strategy: strategy}
+	for _, uri := range uris {
+		if err := b.Add(uri, 1); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Add adds a new upstream server with the given weight.
+// If the upstream server already exists, its weight is updated.
+func (b *Balancer) Add(uri string, weight int) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if weight < 1 {
+		weight = 1
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, upstream := range b.upstreams {
+		if upstream.URL.String() == u.String() {
+			atomic.StoreInt64(&upstream.weight, int64(weight))
+			return nil
+		}
+	}
+
+	// Upstreams are copied on write, so strategies can safely iterate over them
+	upstreams := make([]*Upstream, len(b.upstreams), len(b.upstreams)+1)
+	copy(upstreams, b.upstreams)
+	b.upstreams = append(upstreams, &Upstream{URL: u, weight: int64(weight)})
+	return nil
+}
+
+// Remove removes the given upstream server.
+func (b *Balancer) Remove(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	upstreams := make([]*Upstream, 0, len(b.upstreams))
+	for _, upstream := range b.upstreams {
+		if upstream.URL.String() != u.String() {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	if len(upstreams) == len(b.upstreams) {
+		return ErrUpstreamNotFound
+	}
+	b.upstreams = upstreams
+	return nil
+}
+
+// Upstreams returns the current upstream servers.
+func (b *Balancer) Upstreams() []*Upstream {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.upstreams
+}
+
+// Next returns the upstream server to use for the given request.
+// Unhealthy upstream servers are skipped.
+func (b *Balancer) Next(req *http.Request) (*Upstream, error) {
+	upstreams := b.healthy()
+	if len(upstreams) == 0 {
+		return nil, ErrNoUpstream
+	}
+	u := b.strategy.Next(req, upstreams)
+	if u == nil {
+		return nil, ErrNoUpstream
+	}
+	return u, nil
+}
+
+// Health returns the health state of the upstream servers.
+func (b *Balancer) Health() []UpstreamStatus {
+	checker := b.healthChecker()
+	upstreams := b.Upstreams()
+	status := make([]UpstreamStatus, len(upstreams))
+	for i, u := range upstreams {
+		if checker != nil {
+			status[i] = checker.status(u)
+		} else {
+			status[i] = UpstreamStatus{URL: u.URL.String(), Healthy: true, Conns: u.Conns()}
+		}
+	}
+	return status
+}
+
+// healthy returns the upstream servers that can receive traffic.
+func (b *Balancer) healthy() []*Upstream {
+	checker := b.healthChecker()
+	upstreams := b.Upstreams()
+	if checker == nil {
+		return upstreams
+	}
+	healthy := make([]*Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if checker.healthy(u) {
+			healthy = append(healthy, u)
+		}
+	}
+	return healthy
+}
+
+// observe reports the outcome of a round trip to the health checker, if any.
+func (b *Balancer) observe(u *Upstream, res *http.Response, err error) {
+	if checker := b.healthChecker(); checker != nil {
+		checker.observe(u, res, err)
+	}
+}
+
+// setHealthChecker sets the balancer health checker.
+func (b *Balancer) setHealthChecker(hc *HealthChecker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checker = hc
+}
+
+// healthChecker returns the balancer health checker.
+func (b *Balancer) healthChecker() *HealthChecker {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.checker
+}
+
+// roundRobin implements the round robin balancing strategy.
+type roundRobin struct {
+	next uint64
+}
+
+// RoundRobin returns a strategy that selects upstream servers in turn.
+func RoundRobin() Strategy {
+	return &roundRobin{}
+}
+
+func (s *roundRobin) Next(req *http.Request, upstreams []*Upstream) *Upstream {
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return upstreams[n%uint64(len(upstreams))]
+}
+
+// weightedRoundRobin implements the smooth weighted round robin balancing strategy.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*Upstream]int
+}
+
+// WeightedRoundRobin returns a strategy that selects upstream servers in turn
+// proportionally to their weight, evenly interleaving them.
+func WeightedRoundRobin() Strategy {
+	return &weightedRoundRobin{current: make(map[*Upstream]int)}
+}
+
+func (s *weightedRoundRobin) Next(req *http.Request, upstreams []*Upstream) *Upstream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var best *Upstream
+	var total int
+	current := make(map[*Upstream]int, len(upstreams))
+	for _, u := range upstreams {
+		current[u] = s.current[u] + u.Weight()
+		total += u.Weight()
+		if best == nil || current[u] > current[best] {
+			best = u
+		}
+	}
+	current[best] -= total
+
+	// Discard the state of removed upstream servers
+	s.current = current
+	return best
+}
+
+// leastConnections implements the least connections balancing strategy.
+type leastConnections struct{}
+
+// LeastConnections returns a strategy that selects the upstream server
+// with the fewest in-flight requests.
+func LeastConnections() Strategy {
+	return leastConnections{}
+}
+
+func (leastConnections) Next(req *http.Request, upstreams []*Upstream) *Upstream {
+	best := upstreams[0]
+	for _, u := range upstreams[1:] {
+		if u.Conns() < best.Conns() {
+			best = u
+		}
+	}
+	return best
+}
+
+// consistentHash implements the consistent hashing balancing strategy.
+type consistentHash struct {
+	header string
+}
+
+// ConsistentHash returns a strategy that selects the upstream server based on
+// the hash of the given request header, falling back to the client IP.
+// Adding or removing upstream servers only remaps the keys of the affected servers.
+func ConsistentHash(header string) Strategy {
+	return &consistentHash{header: header}
+}
+
+// Next selects the upstream server using rendezvous hashing.
+func (s *consistentHash) Next(req *http.Request, upstreams []*Upstream) *Upstream {
+	key := req.Header.Get(s.header)
+	if key == "" {
+		key, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+
+	var best *Upstream
+	var max uint64
+	for _, u := range upstreams {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(u.URL.String()))
+		if sum := h.Sum64(); best == nil || sum > max {
+			best, max = u, sum
+		}
+	}
+	return best
+}
+
+// balancerRoundTripper is an http.RoundTripper that forwards
+// every round trip to the upstream server selected by the balancer.
+type balancerRoundTripper struct {
+	next     http.RoundTripper
+	balancer *Balancer
+	passHost bool
+}
+
+// RoundTrip performs the round trip against the selected upstream server.
+func (rt *balancerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := rt.balancer.Next(req)
+	if err != nil {
+		return nil, err
+	}
+
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.URL = utils.CopyURL(req.URL)
+	outReq.URL.Scheme = u.URL.Scheme
+	outReq.URL.Host = u.URL.Host
+	if !rt.passHost {
+		outReq.Host = u.URL.Host
+	}
+
+	u.acquire()
+	res, err := rt.next.RoundTrip(outReq)
+	// upstream timeouts are failures, while the failures caused by the client,
+	// such as cancellations or oversized request bodies, are not
+	if !clientFailed(req) {
+		rt.balancer.observe(u, res, err)
+	}
+	if err != nil {
+		u.release()
+		return nil, err
+	}
+	res.Body = &releaseBody{ReadCloser: res.Body, release: u.release}
+	return res, nil
+}
+
+// releaseBody releases the upstream server once the response body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// Close closes the response body and releases the upstream server.
+func (b *releaseBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
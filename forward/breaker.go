@@ -0,0 +1,248 @@
+package forward
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when the circuit breaker rejects a request.
+var ErrCircuitOpen = errors.New("forward: circuit breaker is open")
+
+// BreakerState represents the circuit breaker state.
+type BreakerState int
+
+const (
+	// BreakerClosed lets the traffic flow to the upstream server.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects the traffic without reaching the upstream server.
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe requests reach
+	// the upstream server in order to decide whether to close the breaker.
+	BreakerHalfOpen
+)
+
+// String returns the breaker state name.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerOptions defines the circuit breaker options.
+type BreakerOptions struct {
+	// Window defines the sliding window duration used to compute the metrics.
+	// Defaults to 10 seconds.
+	Window time.Duration
+	// Buckets defines the number of buckets the sliding window is split into.
+	// Defaults to 10.
+	Buckets int
+	// MinRequests defines the minimum number of requests in the window
+	// required to trip the breaker. Defaults to 10.
+	MinRequests int
+	// ErrorRatio trips the breaker when the ratio of failed requests
+	// in the window reaches the given value, from 0 to 1.
+	// Network errors and 5xx responses are considered failures.
+	ErrorRatio float64
+	// LatencyPercentile defines the latency percentile, from 0 to 1,
+	// compared against LatencyThreshold. Defaults to 0.99.
+	LatencyPercentile float64
+	// LatencyThreshold trips the breaker when the latency percentile
+	// in the window exceeds the given duration.
+	LatencyThreshold time.Duration
+	// OpenDuration defines how long the breaker stays open before
+	// letting probe requests through. Defaults to 10 seconds.
+	OpenDuration time.Duration
+	// HalfOpenRequests defines the number of successful probe requests
+	// required to close the breaker again. Defaults to 1.
+	HalfOpenRequests int
+	// Fallback defines the handler used to reply while the breaker is open.
+	// If no fallback is defined, the forwarder error handler is used,
+	// replying with 503 Service Unavailable by default.
+	Fallback http.Handler
+}
+
+// breakerBucket stores the metrics of a sliding window bucket.
+type breakerBucket struct {
+	start    int64
+	requests int
+	failures int
+	// slow stores the number of requests slower than the latency threshold
+	slow int
+}
+
+// Breaker implements a circuit breaker that trips based on the error ratio
+// or the latency percentile of the upstream round trips in a sliding window.
+type Breaker struct {
+	mu       sync.Mutex
+	options  BreakerOptions
+	state    BreakerState
+	openedAt time.Time
+	inflight int
+	probes   int
+	buckets  []breakerBucket
+	now      func() time.Time
+}
+
+// NewBreaker creates a new circuit breaker with the given options.
+func NewBreaker(options BreakerOptions) *Breaker {
+	if options.Window == 0 {
+		options.Window = 10 * time.Second
+	}
+	if options.Buckets == 0 {
+		options.Buckets = 10
+	}
+	if options.MinRequests == 0 {
+		options.MinRequests = 10
+	}
+	if options.LatencyPercentile == 0 {
+		options.LatencyPercentile = 0.99
+	}
+	if options.OpenDuration == 0 {
+		options.OpenDuration = 10 * time.Second
+	}
+	if options.HalfOpenRequests == 0 {
+		options.HalfOpenRequests = 1
+	}
+	return &Breaker{
+		options: options,
+		buckets: make([]breakerBucket, options.Buckets),
+		now:     time.Now,
+	}
+}
+
+// State returns the current breaker state.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halfOpen()
+	return b.state
+}
+
+// Allow returns true if a request can reach the upstream server.
+// Every allowed request must be followed by a call to Record or Cancel.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halfOpen()
+
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.inflight >= b.options.HalfOpenRequests {
+			return false
+		}
+		b.inflight++
+	}
+	return true
+}
+
+// Record records the outcome of an allowed upstream round trip.
+func (b *Breaker) Record(latency time.Duration, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if b.inflight > 0 {
+			b.inflight--
+		}
+		if failed {
+			b.open()
+			return
+		}
+		b.probes++
+		if b.probes >= b.options.HalfOpenRequests {
+			b.close()
+		}
+	case BreakerClosed:
+		bucket := b.bucket()
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+		if b.options.LatencyThreshold > 0 && latency > b.options.LatencyThreshold {
+			bucket.slow++
+		}
+		if b.tripped() {
+			b.open()
+		}
+	}
+}
+
+// Cancel releases an allowed request without recording its outcome,
+// such as when the client cancels the request.
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen && b.inflight > 0 {
+		b.inflight--
+	}
+}
+
+// halfOpen transitions from open to half-open once the open duration has elapsed.
+func (b *Breaker) halfOpen() {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.options.OpenDuration {
+		b.state = BreakerHalfOpen
+		b.inflight = 0
+		b.probes = 0
+	}
+}
+
+// open trips the breaker.
+func (b *Breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.now()
+}
+
+// close closes the breaker, resetting the window metrics.
+func (b *Breaker) close() {
+	b.state = BreakerClosed
+	b.buckets = make([]breakerBucket, b.options.Buckets)
+}
+
+// bucket returns the window bucket for the current time.
+func (b *Breaker) bucket() *breakerBucket {
+	width := int64(b.options.Window) / int64(b.options.Buckets)
+	start := b.now().UnixNano() / width * width
+	bucket := &b.buckets[(start/width)%int64(len(b.buckets))]
+	if bucket.start != start {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// tripped returns true if the window metrics exceed the configured thresholds.
+func (b *Breaker) tripped() bool {
+	since := b.now().Add(-b.options.Window).UnixNano()
+	var requests, failures, slow int
+	for _, bucket := range b.buckets {
+		if bucket.start <= since {
+			continue
+		}
+		requests += bucket.requests
+		failures += bucket.failures
+		slow += bucket.slow
+	}
+
+	if requests == 0 || requests < b.options.MinRequests {
+		return false
+	}
+	if b.options.ErrorRatio > 0 && float64(failures)/float64(requests) >= b.options.ErrorRatio {
+		return true
+	}
+	if b.options.LatencyThreshold > 0 && slow > 0 {
+		// the latency at the percentile index of the sorted window latencies
+		// exceeds the threshold if every latency from that index on does
+		index := int(float64(requests-1) * b.options.LatencyPercentile)
+		return slow >= requests-index
+	}
+	return false
+}
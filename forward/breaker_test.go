@@ -0,0 +1,203 @@
+package forward
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestBreakerErrorRatio(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(BreakerOptions{MinRequests: 4, ErrorRatio: 0.5, OpenDuration: time.Second})
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		st.Expect(t, b.Allow(), true)
+		b.Record(time.Millisecond, i == 0)
+	}
+	st.Expect(t, b.State(), BreakerClosed)
+	st.Expect(t, b.Allow(), true)
+	b.Record(time.Millisecond, true)
+	st.Expect(t, b.State(), BreakerOpen)
+	st.Expect(t, b.Allow(), false)
+
+	// A single probe request is allowed once the open duration elapses
+	now = now.Add(time.Second)
+	st.Expect(t, b.State(), BreakerHalfOpen)
+	st.Expect(t, b.Allow(), true)
+	st.Expect(t, b.Allow(), false)
+	b.Record(time.Millisecond, true)
+	st.Expect(t, b.State(), BreakerOpen)
+
+	now = now.Add(time.Second)
+	st.Expect(t, b.Allow(), true)
+	b.Record(time.Millisecond, false)
+	st.Expect(t, b.State(), BreakerClosed)
+}
+
+func TestBreakerLatency(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(BreakerOptions{MinRequests: 10, LatencyPercentile: 0.9, LatencyThreshold: 100 * time.Millisecond})
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 9; i++ {
+		b.Allow()
+		b.Record(time.Duration(i)*time.Millisecond, false)
+	}
+	b.Allow()
+	b.Record(time.Second, false)
+	st.Expect(t, b.State(), BreakerClosed)
+
+	b.Allow()
+	b.Record(time.Second, false)
+	st.Expect(t, b.State(), BreakerOpen)
+}
+
+func TestBreakerLatencyPercentile(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, percentile := range []float64{0.5, 0.9, 0.99} {
+		now := time.Now()
+		b := NewBreaker(BreakerOptions{MinRequests: 1, LatencyPercentile: percentile, LatencyThreshold: 100 * time.Millisecond})
+		b.now = func() time.Time { return now }
+		var latencies []time.Duration
+		for i := 0; i < 1000 && b.State() == BreakerClosed; i++ {
+			latency := time.Duration(rnd.Intn(120)) * time.Millisecond
+			latencies = append(latencies, latency)
+			b.Allow()
+			b.Record(latency, false)
+
+			// the breaker trips as soon as the sorted latencies exceed the threshold
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			index := int(float64(len(latencies)-1) * percentile)
+			st.Expect(t, b.State() == BreakerOpen, latencies[index] > 100*time.Millisecond)
+		}
+	}
+}
+
+func TestBreakerSlidingWindow(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(BreakerOptions{Window: time.Second, MinRequests: 2, ErrorRatio: 1})
+	b.now = func() time.Time { return now }
+
+	b.Allow()
+	b.Record(time.Millisecond, true)
+
+	// Metrics out of the window are discarded
+	now = now.Add(2 * time.Second)
+	b.Allow()
+	b.Record(time.Millisecond, true)
+	st.Expect(t, b.State(), BreakerClosed)
+	b.Allow()
+	b.Record(time.Millisecond, true)
+	st.Expect(t, b.State(), BreakerOpen)
+}
+
+func TestForwardCircuitBreaker(t *testing.T) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer srv.Close()
+
+	b := NewBreaker(BreakerOptions{MinRequests: 2, ErrorRatio: 1, OpenDuration: time.Minute})
+	f, err := New(CircuitBreaker(b))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		st.Expect(t, err, nil)
+		st.Expect(t, re.StatusCode, http.StatusInternalServerError)
+	}
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusServiceUnavailable)
+	st.Expect(t, atomic.LoadInt32(&calls), int32(2))
+}
+
+func TestForwardCircuitBreakerFallback(t *testing.T) {
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("fallback"))
+	})
+	b := NewBreaker(BreakerOptions{Fallback: fallback})
+	b.open()
+
+	f, err := New(CircuitBreaker(b))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost:63450")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, string(body), "fallback")
+}
+
+func TestForwardCircuitBreakerCancelledProbe(t *testing.T) {
+	var blocking int32 = 1
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&blocking) == 1 {
+			<-req.Context().Done()
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	now := time.Now()
+	var mu sync.Mutex
+	b := NewBreaker(BreakerOptions{OpenDuration: time.Second})
+	b.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	b.open()
+	mu.Lock()
+	now = now.Add(time.Second)
+	mu.Unlock()
+
+	f, err := New(CircuitBreaker(b))
+	st.Expect(t, err, nil)
+	done := make(chan bool, 1)
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+		done <- true
+	})
+	defer proxy.Close()
+
+	// the client gives up on the half-open probe request
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	_, err = client.Get(proxy.URL)
+	st.Reject(t, err, nil)
+	<-done
+	st.Expect(t, b.State(), BreakerHalfOpen)
+
+	// the probe slot is released, so the next request reaches the upstream server
+	atomic.StoreInt32(&blocking, 0)
+	re, body, err := testutils.Get(proxy.URL)
+	<-done
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, string(body), "hello")
+	st.Expect(t, b.State(), BreakerClosed)
+}
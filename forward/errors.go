@@ -0,0 +1,220 @@
+package forward
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// Phase identifies the forwarding phase where an upstream error happened.
+type Phase string
+
+const (
+	// PhaseDial identifies errors while dialing the upstream server.
+	PhaseDial Phase = "dial"
+	// PhaseTLSHandshake identifies errors during the upstream TLS handshake.
+	PhaseTLSHandshake Phase = "tls_handshake"
+	// PhaseWriteRequest identifies errors while writing the request to the upstream server.
+	PhaseWriteRequest Phase = "write_request"
+	// PhaseReadHeaders identifies errors while reading the upstream response headers.
+	PhaseReadHeaders Phase = "read_headers"
+	// PhaseCopyBody identifies errors while copying the upstream response body.
+	PhaseCopyBody Phase = "copy_body"
+	// PhaseHijack identifies errors while hijacking the client connection.
+	PhaseHijack Phase = "hijack"
+)
+
+// Error represents an upstream forwarding error.
+// It implements the net.Error interface.
+type Error struct {
+	// Phase stores the forwarding phase where the error happened.
+	Phase Phase
+	// Addr stores the upstream server address.
+	Addr string
+	// Err stores the underlying error.
+	Err error
+}
+
+// newError creates a new forwarding error for the given phase and upstream address.
+func newError(phase Phase, addr string, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Phase: phase, Addr: addr, Err: err}
+}
+
+// Error returns the error message.
+func (e *Error) Error() string {
+	return fmt.Sprintf("forward: %s %s: %v", e.Phase, e.Addr, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true if the error was caused by a timeout.
+func (e *Error) Timeout() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Temporary returns true if the error is temporary.
+func (e *Error) Temporary() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// timeoutError is used to report upstream round trips
+// exceeding the configured timeouts.
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// StatusHandler is an error handler that maps forwarding errors
+// to the proper HTTP status code:
+//
+//   - 504 Gateway Timeout if the upstream timed out.
+//   - 503 Service Unavailable if the upstream cannot be reached
+//     or the circuit breaker is open.
+//   - 413 Request Entity Too Large if the request body exceeds the maximum size.
+//   - 415 Unsupported Media Type if the request body encoding cannot be transformed.
+//   - 400 Bad Request if the request body cannot be read or decoded.
+//   - 502 Bad Gateway for any other upstream error.
+type StatusHandler struct {
+	// JSON enables replying with a JSON body describing the error.
+	// The upstream address is never exposed to the client.
+	JSON bool
+}
+
+// DefaultErrorHandler stores the error handler used by default by the forwarder.
+var DefaultErrorHandler = &StatusHandler{}
+
+// StatusCode returns the HTTP status code for the given error.
+func (h *StatusHandler) StatusCode(err error) int {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	if err == ErrCircuitOpen {
+		return http.StatusServiceUnavailable
+	}
+	if err == ErrRequestTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	if err == ErrUnsupportedEncoding {
+		return http.StatusUnsupportedMediaType
+	}
+	if err == ErrInvalidRequestBody {
+		return http.StatusBadRequest
+	}
+	if e, ok := err.(*Error); ok && e.Phase == PhaseDial {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// ServeHTTP replies to the client with the proper status code for the given error.
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	status := h.StatusCode(err)
+	if !h.JSON {
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+		return
+	}
+
+	body := struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+		Phase   Phase  `json:"phase,omitempty"`
+		Timeout bool   `json:"timeout"`
+	}{Status: status, Message: http.StatusText(status)}
+	if e, ok := err.(*Error); ok {
+		body.Phase = e.Phase
+	}
+	if ne, ok := err.(net.Error); ok {
+		body.Timeout = ne.Timeout()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// phaseTracker keeps track of the current upstream round trip phase
+// and the dialed upstream address.
+type phaseTracker struct {
+	mu     sync.Mutex
+	phase  Phase
+	remote string
+}
+
+// set updates the current phase.
+func (t *phaseTracker) set(phase Phase) {
+	t.mu.Lock()
+	t.phase = phase
+	t.mu.Unlock()
+}
+
+// get returns the current phase.
+func (t *phaseTracker) get() Phase {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.phase
+}
+
+// setAddr updates the dialed upstream address.
+func (t *phaseTracker) setAddr(addr string) {
+	t.mu.Lock()
+	t.remote = addr
+	t.mu.Unlock()
+}
+
+// addr returns the dialed upstream address, or the given default address
+// if no connection has been attempted.
+func (t *phaseTracker) addr(def string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.remote == "" {
+		return def
+	}
+	return t.remote
+}
+
+// trace returns the httptrace.ClientTrace used to track the round trip phases.
+func (t *phaseTracker) trace() *httptrace.ClientTrace {
+	t.set(PhaseDial)
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			t.setAddr(hostPort)
+			t.set(PhaseDial)
+		},
+		ConnectStart: func(network, addr string) {
+			t.setAddr(addr)
+		},
+		TLSHandshakeStart: func() {
+			t.set(PhaseTLSHandshake)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				t.set(PhaseWriteRequest)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.setAddr(info.Conn.RemoteAddr().String())
+			t.set(PhaseWriteRequest)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				t.set(PhaseReadHeaders)
+			}
+		},
+	}
+}
@@ -0,0 +1,94 @@
+package forward
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlushImmediately can be used as flush interval to flush
+// the response body to the client after every write.
+const FlushImmediately = time.Duration(-1)
+
+// flushWriter is an io.Writer that flushes the written data
+// to the client after the configured latency.
+type flushWriter struct {
+	mu      sync.Mutex
+	dst     io.Writer
+	flusher http.Flusher
+	latency time.Duration
+	timer   *time.Timer
+	pending bool
+}
+
+// newFlushWriter creates a new flushWriter for the given writer and latency.
+// A negative latency flushes the data immediately after every write.
+func newFlushWriter(w io.Writer, flusher http.Flusher, latency time.Duration) *flushWriter {
+	return &flushWriter{dst: w, flusher: flusher, latency: latency}
+}
+
+// Write writes the given data and schedules a flush.
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	n, err := fw.dst.Write(p)
+	if fw.latency < 0 {
+		fw.flusher.Flush()
+		return n, err
+	}
+	if fw.pending {
+		return n, err
+	}
+	if fw.timer == nil {
+		fw.timer = time.AfterFunc(fw.latency, fw.delayedFlush)
+	} else {
+		fw.timer.Reset(fw.latency)
+	}
+	fw.pending = true
+	return n, err
+}
+
+// delayedFlush flushes the pending data, if any.
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if !fw.pending {
+		return
+	}
+	fw.flusher.Flush()
+	fw.pending = false
+}
+
+// stop cancels any pending flush.
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.pending = false
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
+
+// flushInterval returns the flush interval to use for the given upstream response.
+// Streaming responses, such as server-sent events, gRPC streams or responses
+// with unknown length, are always flushed immediately.
+func flushInterval(res *http.Response, interval time.Duration) time.Duration {
+	if isStream(res) {
+		return FlushImmediately
+	}
+	if res.ContentLength == -1 {
+		return FlushImmediately
+	}
+	return interval
+}
+
+// isStream returns true if the given upstream response is a stream,
+// such as server-sent events or gRPC streams.
+func isStream(res *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || strings.HasPrefix(mediaType, "application/grpc")
+}
@@ -4,8 +4,12 @@
 package forward
 
 import (
+	"crypto/tls"
+	"errors"
+	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"gopkg.in/vinxi/utils.v0"
 )
@@ -27,8 +31,104 @@ func PassHostHeader(b bool) OptSetter {
 	}
 }
 
+// FlushInterval specifies the interval to flush the response body to the client
+// while it's copied from the upstream server.
+// Use FlushImmediately to flush after every write. Zero disables periodic flushing.
+// Server-sent events and responses with unknown length are always flushed immediately.
+func FlushInterval(interval time.Duration) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.flushInterval = interval
+		return nil
+	}
+}
+
+// Timeout specifies the maximum duration of the whole upstream round trip,
+// including reading the response body.
+// Exceeding the timeout replies with 504 Gateway Timeout.
+func Timeout(timeout time.Duration) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.timeout = timeout
+		return nil
+	}
+}
+
+// ResponseHeaderTimeout specifies the maximum amount of time to wait
+// for the upstream response headers once the request, including its body,
+// has been written. Slow request uploads are not limited by this timeout.
+// Exceeding the timeout replies with 504 Gateway Timeout.
+func ResponseHeaderTimeout(timeout time.Duration) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.responseHeaderTimeout = timeout
+		return nil
+	}
+}
+
+// MaxRequestBytes defines the maximum size in bytes of the request bodies.
+// Oversized requests are rejected with 413 Request Entity Too Large.
+func MaxRequestBytes(n int64) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.maxRequestBytes = n
+		return nil
+	}
+}
+
+// MaxResponseBytes defines the maximum size in bytes of the upstream response bodies.
+// Oversized responses are replied with 502 Bad Gateway, or aborted if the
+// response headers have already been sent.
+func MaxResponseBytes(n int64) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.maxResponseBytes = n
+		return nil
+	}
+}
+
+// Buffering enables the buffered forwarding mode: upstream responses are fully read,
+// in memory up to a threshold and then in a temporary file, before being written
+// to the client. The configured hook can inspect and rewrite the buffered responses.
+// Streaming responses, such as server-sent events or gRPC streams, are not buffered.
+func Buffering(options BufferOptions) OptSetter {
+	return func(f *Forwarder) error {
+		if options.MemoryBytes == 0 {
+			options.MemoryBytes = DefaultMemoryBytes
+		}
+		f.httpForwarder.buffer = &options
+		return nil
+	}
+}
+
+// Retry enables retrying failed upstream round trips based on the given policy.
+// Any round trip error, such as a reset keep-alive connection during a rolling
+// backend restart, is retried up to the policy attempts. Only idempotent requests
+// are retried unless NonIdempotent is enabled, while requests whose body exceeds
+// MaxBodyBytes or which are cancelled by the client are never retried.
+func Retry(policy RetryPolicy) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.retry = &policy
+		return nil
+	}
+}
+
+// Balance balances the forwarded traffic across the upstream servers of the given balancer,
+// overriding the request target URL.
+func Balance(b *Balancer) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.balancer = b
+		f.websocketForwarder.balancer = b
+		return nil
+	}
+}
+
+// CircuitBreaker enables the given circuit breaker around the upstream round trips.
+// While the breaker is open, requests fail fast without reaching the upstream server.
+func CircuitBreaker(b *Breaker) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.breaker = b
+		return nil
+	}
+}
+
 // RoundTripper sets a new http.RoundTripper
-// Forwarder will use http.DefaultTransport as a default round tripper
+// Forwarder will use DefaultTransport as a default round tripper
 func RoundTripper(r http.RoundTripper) OptSetter {
 	return func(f *Forwarder) error {
 		f.roundTripper = r
@@ -36,6 +136,15 @@ func RoundTripper(r http.RoundTripper) OptSetter {
 	}
 }
 
+// H2C enables forwarding the cleartext traffic to HTTP/2 upstream servers
+// with prior knowledge. TLS traffic is still forwarded using the round tripper.
+func H2C() OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.h2c = true
+		return nil
+	}
+}
+
 // Rewriter defines a request rewriter for the HTTP forwarder
 func Rewriter(r ReqRewriter) OptSetter {
 	return func(f *Forwarder) error {
@@ -44,6 +153,16 @@ func Rewriter(r ReqRewriter) OptSetter {
 	}
 }
 
+// ResponseRewriter defines a response rewriter for the HTTP forwarder,
+// called with the upstream response and the original request before
+// the response headers are copied. Multiple rewriters are called in order.
+func ResponseRewriter(r RespRewriter) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.respRewriters = append(f.httpForwarder.respRewriters, r)
+		return nil
+	}
+}
+
 // WebsocketRewriter defines a request rewriter for the websocket forwarder
 func WebsocketRewriter(r ReqRewriter) OptSetter {
 	return func(f *Forwarder) error {
@@ -52,7 +171,116 @@ func WebsocketRewriter(r ReqRewriter) OptSetter {
 	}
 }
 
-// ErrorHandler is a functional argument that sets error handler of the server
+// WebsocketTLSConfig defines the TLS configuration used to connect to secure websocket upstream servers
+func WebsocketTLSConfig(c *tls.Config) OptSetter {
+	return func(f *Forwarder) error {
+		f.websocketForwarder.TLSClientConfig = c
+		return nil
+	}
+}
+
+// TLS defines the TLS options used to connect to the upstream servers,
+// both for HTTP and secure websocket forwarding. The certificate files
+// are loaded right away, and reloaded once they change.
+// TLS options cannot be combined with a custom round tripper.
+func TLS(options TLSOptions) OptSetter {
+	return func(f *Forwarder) error {
+		u, err := newUpstreamTLS(options)
+		if err != nil {
+			return err
+		}
+		f.tlsConfigs().def = u
+		return nil
+	}
+}
+
+// UpstreamTLS defines the TLS options used to connect to the given upstream host,
+// overriding the TLS options for that host. The host may include the port.
+func UpstreamTLS(host string, options TLSOptions) OptSetter {
+	return func(f *Forwarder) error {
+		u, err := newUpstreamTLS(options)
+		if err != nil {
+			return err
+		}
+		f.tlsConfigs().hosts[host] = u
+		return nil
+	}
+}
+
+// WebsocketDialer defines the dialer used to connect to websocket upstream servers.
+// Forwarder will use a dialer with a 30 seconds connect timeout by default
+func WebsocketDialer(d *net.Dialer) OptSetter {
+	return func(f *Forwarder) error {
+		f.websocketForwarder.dialer = d
+		return nil
+	}
+}
+
+// WebsocketTimeouts defines the idle and maximum duration of websocket tunnels.
+// Tunnels are closed if no data flows in either direction during the idle timeout,
+// or once the max duration is exceeded. Zero disables the given timeout.
+func WebsocketTimeouts(idle, max time.Duration) OptSetter {
+	return func(f *Forwarder) error {
+		f.websocketForwarder.idleTimeout = idle
+		f.websocketForwarder.maxDuration = max
+		return nil
+	}
+}
+
+// WebsocketHandshakeTimeout defines the maximum duration of the upstream TLS
+// and websocket handshakes. Defaults to DefaultWebsocketHandshakeTimeout.
+func WebsocketHandshakeTimeout(timeout time.Duration) OptSetter {
+	return func(f *Forwarder) error {
+		f.websocketForwarder.handshake = timeout
+		return nil
+	}
+}
+
+// WebsocketMessageHook enables the websocket frame parsing mode, passing every
+// data message flowing through the tunnels to the given hooks in order.
+// Control frames are forwarded as they are, while fragmented messages are
+// reassembled before being passed to the hooks.
+// Websocket extensions are not negotiated with the upstream server in this mode.
+func WebsocketMessageHook(hooks ...MessageHook) OptSetter {
+	return func(f *Forwarder) error {
+		f.websocketForwarder.hooks = append(f.websocketForwarder.hooks, hooks...)
+		return nil
+	}
+}
+
+// WebsocketMaxMessageSize defines the maximum size in bytes of the websocket
+// messages accepted in the frame parsing mode. Defaults to DefaultMaxMessageSize.
+func WebsocketMaxMessageSize(size int64) OptSetter {
+	return func(f *Forwarder) error {
+		f.websocketForwarder.maxMessageSize = size
+		return nil
+	}
+}
+
+// WebsocketTunnels defines the registry used to keep track of the active websocket tunnels.
+// Forwarder will use the registry stored in the request context by WithTunnels,
+// such as the one of a vinxi server, or DefaultTunnels if no registry has been specified.
+func WebsocketTunnels(ts *Tunnels) OptSetter {
+	return func(f *Forwarder) error {
+		f.websocketForwarder.tunnels = ts
+		return nil
+	}
+}
+
+// GRPC enables the gRPC proxying mode. gRPC requests are forwarded to cleartext
+// upstream servers using HTTP/2 with prior knowledge, honouring the gRPC timeout,
+// and forwarding errors are reported to the client as gRPC error statuses.
+// Incoming gRPC requests require the server to support HTTP/2.
+func GRPC() OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.grpc = true
+		return nil
+	}
+}
+
+// ErrorHandler is a functional argument that sets error handler of the server.
+// Forwarding errors are reported as *Error, exposing the failed phase.
+// Forwarder will use DefaultErrorHandler if no error handler has been specified.
 func ErrorHandler(h utils.ErrorHandler) OptSetter {
 	return func(f *Forwarder) error {
 		f.errHandler = h
@@ -95,25 +323,78 @@ func New(setters ...OptSetter) (*Forwarder, error) {
 			return nil, err
 		}
 	}
+	if f.httpForwarder.tls != nil {
+		if f.httpForwarder.roundTripper != nil {
+			return nil, errors.New("forward: TLS options cannot be combined with a custom round tripper")
+		}
+		if f.websocketForwarder.TLSClientConfig != nil {
+			return nil, errors.New("forward: TLS options cannot be combined with a websocket TLS config")
+		}
+		f.httpForwarder.roundTripper = &tlsRoundTripper{configs: f.httpForwarder.tls}
+	}
 	if f.httpForwarder.roundTripper == nil {
-		f.httpForwarder.roundTripper = utils.DefaultTransport
+		f.httpForwarder.roundTripper = DefaultTransport
 	}
 	if f.httpForwarder.rewriter == nil {
 		h, err := os.Hostname()
 		if err != nil {
 			h = "localhost"
 		}
-		f.httpForwarder.rewriter = &HeaderRewriter{TrustForwardHeader: true, Hostname: h}
+		// forwarded headers sent by clients are not trusted by default
+		f.httpForwarder.rewriter = &HeaderRewriter{Hostname: h}
+	}
+	if f.websocketForwarder.rewriter == nil {
+		f.websocketForwarder.rewriter = f.httpForwarder.rewriter
+	}
+	if f.websocketForwarder.handshake == 0 {
+		f.websocketForwarder.handshake = DefaultWebsocketHandshakeTimeout
+	}
+	if f.websocketForwarder.maxMessageSize == 0 {
+		f.websocketForwarder.maxMessageSize = DefaultMaxMessageSize
 	}
 	if f.log == nil {
 		f.log = utils.NullLogger
 	}
 	if f.errHandler == nil {
-		f.errHandler = utils.DefaultHandler
+		f.errHandler = DefaultErrorHandler
+	}
+	if f.httpForwarder.grpc {
+		f.errHandler = &grpcErrorHandler{next: f.errHandler}
+	}
+	if f.httpForwarder.h2c || f.httpForwarder.grpc {
+		f.httpForwarder.roundTripper = &h2cRoundTripper{
+			next: f.httpForwarder.roundTripper,
+			h2c:  newH2CTransport(),
+			grpc: !f.httpForwarder.h2c,
+		}
+	}
+	if f.httpForwarder.balancer != nil {
+		f.httpForwarder.roundTripper = &balancerRoundTripper{
+			next:     f.httpForwarder.roundTripper,
+			balancer: f.httpForwarder.balancer,
+			passHost: f.httpForwarder.passHost,
+		}
+	}
+	if f.httpForwarder.retry != nil {
+		f.httpForwarder.roundTripper = &retryRoundTripper{
+			next:   f.httpForwarder.roundTripper,
+			policy: *f.httpForwarder.retry,
+			log:    f.log,
+		}
 	}
 	return f, nil
 }
 
+// tlsConfigs returns the upstream TLS configurations shared by the HTTP
+// and websocket forwarders, creating them if needed.
+func (f *Forwarder) tlsConfigs() *tlsConfigs {
+	if f.httpForwarder.tls == nil {
+		f.httpForwarder.tls = &tlsConfigs{hosts: make(map[string]*upstreamTLS)}
+		f.websocketForwarder.tls = f.httpForwarder.tls
+	}
+	return f.httpForwarder.tls
+}
+
 // ServeHTTP decides which forwarder to use based on the specified
 // request and delegates to the proper implementation
 func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,101 @@
+package forward
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestForwardedElementString(t *testing.T) {
+	cases := []struct {
+		element  ForwardedElement
+		expected string
+	}{
+		{ForwardedElement{For: "192.0.2.60", Proto: "http", By: "203.0.113.43"}, "for=192.0.2.60;by=203.0.113.43;proto=http"},
+		{ForwardedElement{For: ForwardedNode("2001:db8:cafe::17", "4711")}, `for="[2001:db8:cafe::17]:4711"`},
+		{ForwardedElement{For: "_hidden", By: "_SEVKISEK", Host: "example.com:8080"}, `for=_hidden;by=_SEVKISEK;host="example.com:8080"`},
+		{ForwardedElement{For: "unknown", Host: `a"b`}, `for=unknown;host="a\"b"`},
+	}
+	for _, c := range cases {
+		st.Expect(t, c.element.String(), c.expected)
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	h := http.Header{}
+	h.Add(Forwarded, `for="_gazonk"`)
+	h.Add(Forwarded, `For="[2001:db8:cafe::17]:4711";proto=https, for=192.0.2.43;host="a,b;c", for=unknown`)
+	h.Add(Forwarded, `invalid`)
+
+	st.Expect(t, ParseForwarded(h), []ForwardedElement{
+		{For: "_gazonk"},
+		{For: "[2001:db8:cafe::17]:4711", Proto: "https"},
+		{For: "192.0.2.43", Host: "a,b;c"},
+		{For: "unknown"},
+	})
+}
+
+func TestHeaderRewriterForwardedModes(t *testing.T) {
+	networks, _ := ParseCIDRs("10.0.0.0/8")
+	cases := []struct {
+		mode       ForwardedMode
+		remoteAddr string
+		forwarded  string
+		xff        string
+	}{
+		{ForwardedLegacy, "10.0.0.1:1234", "for=1.2.3.4", "10.0.0.1"},
+		{ForwardedLegacy, "8.8.8.8:1234", "", "8.8.8.8"},
+		{ForwardedStandard, "10.0.0.1:1234", "for=1.2.3.4, for=10.0.0.1;by=_proxy;proto=https;host=proxy.com", ""},
+		{ForwardedStandard, "8.8.8.8:1234", "for=8.8.8.8;by=_proxy;proto=https;host=proxy.com", ""},
+		{ForwardedBoth, "[2001:db8::1]:1234", `for="[2001:db8::1]";by=_proxy;proto=https;host=proxy.com`, "2001:db8::1"},
+	}
+	for _, c := range cases {
+		rw := &HeaderRewriter{TrustedProxies: networks, Forwarded: c.mode, ForwardedBy: "_proxy"}
+		req := &http.Request{RemoteAddr: c.remoteAddr, Host: "proxy.com", TLS: &tls.ConnectionState{}, Header: http.Header{}}
+		req.Header.Set(Forwarded, "for=1.2.3.4")
+		rw.Rewrite(req)
+		st.Expect(t, req.Header.Get(Forwarded), c.forwarded)
+		st.Expect(t, req.Header.Get(XForwardedFor), c.xff)
+	}
+}
+
+func TestHeaderRewriterForwardedClientIP(t *testing.T) {
+	networks, _ := ParseCIDRs("10.0.0.0/8")
+	req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+	req.Header.Set(Forwarded, `for="[2001:db8::1]:4711", for=10.0.0.2`)
+	req.Header.Set(XForwardedFor, "1.2.3.4")
+
+	rw := &HeaderRewriter{TrustedProxies: networks}
+	st.Expect(t, rw.ClientIP(req), "1.2.3.4")
+	rw.Forwarded = ForwardedBoth
+	st.Expect(t, rw.ClientIP(req), "2001:db8::1")
+	rw.Forwarded = ForwardedStandard
+	req.Header.Del(Forwarded)
+	st.Expect(t, rw.ClientIP(req), "10.0.0.1")
+}
+
+func TestHeaderRewriterForwardedClientHost(t *testing.T) {
+	var header http.Header
+	var host string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		header, host = req.Header, req.Host
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL, Rewriter(&HeaderRewriter{Forwarded: ForwardedBoth, ForwardedBy: "_proxy"}))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Host = "proxy.com"
+	res, err := http.DefaultClient.Do(req)
+	st.Expect(t, err, nil)
+	res.Body.Close()
+
+	// the upstream host is sent, while the forwarding headers keep the client host
+	st.Expect(t, host, testutils.ParseURI(srv.URL).Host)
+	st.Expect(t, header.Get(XForwardedHost), "proxy.com")
+	st.Expect(t, header.Get(Forwarded), "for=127.0.0.1;by=_proxy;proto=http;host=proxy.com")
+}
@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/vinxi/utils.v0"
+)
+
+// gRPC status codes used to report forwarding errors,
+// as defined by the gRPC specification.
+const (
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+)
+
+// gRPC headers.
+const (
+	GRPCStatus  = "Grpc-Status"
+	GRPCMessage = "Grpc-Message"
+	GRPCTimeout = "Grpc-Timeout"
+)
+
+// IsGRPCRequest returns true if the given request is a gRPC request.
+// gRPC-Web requests are not considered gRPC requests.
+func IsGRPCRequest(req *http.Request) bool {
+	if req.ProtoMajor != 2 {
+		return false
+	}
+	contentType := req.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/grpc") {
+		return false
+	}
+	rest := contentType[len("application/grpc"):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// grpcTimeout parses the gRPC timeout header of the given request.
+func grpcTimeout(h http.Header) (time.Duration, bool) {
+	value := h.Get(GRPCTimeout)
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// grpcErrorHandler replies to gRPC requests with a gRPC error status
+// instead of an HTTP error, delegating any other request to the next handler.
+type grpcErrorHandler struct {
+	next utils.ErrorHandler
+}
+
+// ServeHTTP replies to the client with the gRPC status for the given error.
+func (h *grpcErrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if !IsGRPCRequest(req) {
+		h.next.ServeHTTP(w, req, err)
+		return
+	}
+
+	status := grpcUnavailable
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		status = grpcDeadlineExceeded
+	}
+	if e, ok := err.(*Error); err == ErrRequestTooLarge || ok && e.Err == ErrResponseTooLarge {
+		status = grpcResourceExhausted
+	}
+	if err == ErrInvalidRequestBody {
+		status = grpcInvalidArgument
+	}
+	message := url.PathEscape(http.StatusText(DefaultErrorHandler.StatusCode(err)))
+
+	// the response headers are already sent when copying the body,
+	// so the status can only be sent as trailers
+	if e, ok := err.(*Error); ok && e.Phase == PhaseCopyBody {
+		w.Header().Set(http.TrailerPrefix+GRPCStatus, strconv.Itoa(status))
+		w.Header().Set(http.TrailerPrefix+GRPCMessage, message)
+		return
+	}
+
+	// trailers-only response, as defined by the gRPC specification
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set(GRPCStatus, strconv.Itoa(status))
+	w.Header().Set(GRPCMessage, message)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,166 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newH2CServer starts a new cleartext HTTP/2 test server.
+func newH2CServer(handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+// newGRPCProxy starts a new cleartext HTTP/2 proxy forwarding to the given target URL.
+func newGRPCProxy(t *testing.T, target string, opts ...OptSetter) *httptest.Server {
+	return newH2CServer(newProxyHandler(t, target, append([]OptSetter{GRPC()}, opts...)...))
+}
+
+// grpcClient sends the given gRPC request to the server using HTTP/2 with prior knowledge.
+func grpcClient(t *testing.T, url string, body io.Reader, header http.Header) *http.Response {
+	client := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	req, _ := http.NewRequest("POST", url+"/echo.Echo/Stream", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := client.RoundTrip(req)
+	st.Expect(t, err, nil)
+	return res
+}
+
+func TestIsGRPCRequest(t *testing.T) {
+	cases := []struct {
+		contentType string
+		proto       int
+		expected    bool
+	}{
+		{"application/grpc", 2, true},
+		{"application/grpc+proto", 2, true},
+		{"application/grpc; charset=utf-8", 2, true},
+		{"application/grpc-web", 2, false},
+		{"application/json", 2, false},
+		{"application/grpc", 1, false},
+	}
+	for _, c := range cases {
+		req := &http.Request{ProtoMajor: c.proto, Header: http.Header{"Content-Type": {c.contentType}}}
+		st.Expect(t, IsGRPCRequest(req), c.expected)
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"1H", time.Hour, true},
+		{"5M", 5 * time.Minute, true},
+		{"10S", 10 * time.Second, true},
+		{"100m", 100 * time.Millisecond, true},
+		{"7u", 7 * time.Microsecond, true},
+		{"9n", 9, true},
+		{"100", 0, false},
+		{"123456789S", 0, false},
+		{"S", 0, false},
+	}
+	for _, c := range cases {
+		d, ok := grpcTimeout(http.Header{GRPCTimeout: {c.value}})
+		st.Expect(t, ok, c.ok)
+		st.Expect(t, d, c.expected)
+	}
+}
+
+func TestGRPCBidiStreaming(t *testing.T) {
+	srv := newH2CServer(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set(Trailer, GRPCStatus)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		msg := make([]byte, 5)
+		for {
+			if _, err := io.ReadFull(req.Body, msg); err != nil {
+				break
+			}
+			w.Write(msg)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(GRPCStatus, "0")
+	})
+	defer srv.Close()
+
+	proxy := newGRPCProxy(t, srv.URL)
+	defer proxy.Close()
+
+	pr, pw := io.Pipe()
+	res := grpcClient(t, proxy.URL, pr, nil)
+	st.Expect(t, res.StatusCode, http.StatusOK)
+
+	// every message is echoed before the next one is sent
+	for _, msg := range []string{"hello", "world"} {
+		pw.Write([]byte(msg))
+		reply := make([]byte, 5)
+		_, err := io.ReadFull(res.Body, reply)
+		st.Expect(t, err, nil)
+		st.Expect(t, string(reply), msg)
+	}
+	pw.Close()
+
+	_, err := io.Copy(ioutil.Discard, res.Body)
+	st.Expect(t, err, nil)
+	st.Expect(t, res.Trailer.Get(GRPCStatus), "0")
+}
+
+func TestGRPCUnavailable(t *testing.T) {
+	proxy := newGRPCProxy(t, "http://localhost:63450")
+	defer proxy.Close()
+
+	res := grpcClient(t, proxy.URL, nil, nil)
+	st.Expect(t, res.StatusCode, http.StatusOK)
+	st.Expect(t, res.Header.Get("Content-Type"), "application/grpc")
+	st.Expect(t, res.Header.Get(GRPCStatus), "14")
+	st.Expect(t, res.Header.Get(GRPCMessage), "Service%20Unavailable")
+}
+
+func TestGRPCDeadlineExceeded(t *testing.T) {
+	srv := newH2CServer(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	defer srv.Close()
+
+	proxy := newGRPCProxy(t, srv.URL)
+	defer proxy.Close()
+
+	res := grpcClient(t, proxy.URL, nil, http.Header{GRPCTimeout: {"50m"}})
+	st.Expect(t, res.StatusCode, http.StatusOK)
+	st.Expect(t, res.Header.Get(GRPCStatus), "4")
+}
+
+func TestGRPCErrorHandlerNonGRPC(t *testing.T) {
+	h := &grpcErrorHandler{next: DefaultErrorHandler}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost", nil)
+	h.ServeHTTP(w, req, ErrCircuitOpen)
+	st.Expect(t, w.Code, http.StatusServiceUnavailable)
+	st.Expect(t, w.Header().Get(GRPCStatus), "")
+}
@@ -1,5 +1,10 @@
 package forward
 
+import (
+	"net/http"
+	"strings"
+)
+
 const (
 	// XForwardedProto stores the forwarder proto header key.
 	XForwardedProto = "X-Forwarded-Proto"
@@ -9,10 +14,14 @@ const (
 	XForwardedHost = "X-Forwarded-Host"
 	// XForwardedServer stores the forward server header key.
 	XForwardedServer = "X-Forwarded-Server"
+	// Forwarded stores the RFC 7239 forwarded header key.
+	Forwarded = "Forwarded"
 	// Connection stores the connection header key.
 	Connection = "Connection"
 	// KeepAlive stores the keep alive header key.
 	KeepAlive = "Keep-Alive"
+	// ProxyConnection stores the non-standard proxy connection header key.
+	ProxyConnection = "Proxy-Connection"
 	// ProxyAuthenticate stores the proxy header key.
 	ProxyAuthenticate = "Proxy-Authenticate"
 	// ProxyAuthorization stores the proxy authorization header key.
@@ -21,20 +30,42 @@ const (
 	Te = "Te" // canonicalized version of "TE"
 	// Trailers stores the trailers header key.
 	Trailers = "Trailers"
+	// Trailer stores the trailer header key used to declare trailer fields.
+	Trailer = "Trailer"
 	// TransferEncoding stores the transfer encoding header key.
 	TransferEncoding = "Transfer-Encoding"
 	// Upgrade stores the update header key.
 	Upgrade = "Upgrade"
 	// ContentLength stores the content length header key.
 	ContentLength = "Content-Length"
+	// ContentEncoding stores the content encoding header key.
+	ContentEncoding = "Content-Encoding"
+	// AcceptEncoding stores the accept encoding header key.
+	AcceptEncoding = "Accept-Encoding"
+	// Location stores the location header key.
+	Location = "Location"
+	// ContentLocation stores the content location header key.
+	ContentLocation = "Content-Location"
+	// SetCookie stores the set cookie header key.
+	SetCookie = "Set-Cookie"
+	// SecWebsocketKey stores the websocket handshake key header key.
+	SecWebsocketKey = "Sec-Websocket-Key"
+	// SecWebsocketAccept stores the websocket handshake accept header key.
+	SecWebsocketAccept = "Sec-Websocket-Accept"
+	// SecWebsocketProtocol stores the websocket subprotocol header key.
+	SecWebsocketProtocol = "Sec-Websocket-Protocol"
+	// SecWebsocketExtensions stores the websocket extensions header key.
+	SecWebsocketExtensions = "Sec-Websocket-Extensions"
 )
 
 // HopHeaders stores the hop-by-hop headers.
-// These are removed when sent to the backend.
-// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+// These are removed from the requests sent to the backend and from its responses,
+// along with the headers listed in the Connection header.
+// https://tools.ietf.org/html/rfc7230#section-6.1
 var HopHeaders = []string{
 	Connection,
 	KeepAlive,
+	ProxyConnection,
 	ProxyAuthenticate,
 	ProxyAuthorization,
 	Te, // canonicalized version of "TE"
@@ -42,3 +73,50 @@ var HopHeaders = []string{
 	TransferEncoding,
 	Upgrade,
 }
+
+// RemoveHopHeaders removes the hop-by-hop headers from the given header map,
+// including the headers listed as Connection tokens.
+// If keepUpgrade is true, the Upgrade header and the Connection upgrade token
+// are kept for protocol switches.
+func RemoveHopHeaders(h http.Header, keepUpgrade bool) {
+	upgrade := ""
+	if keepUpgrade && headerContainsToken(h, Connection, "upgrade") {
+		upgrade = h.Get(Upgrade)
+	}
+
+	for _, token := range headerTokens(h, Connection) {
+		h.Del(token)
+	}
+	for _, key := range HopHeaders {
+		h.Del(key)
+	}
+
+	if upgrade != "" {
+		h.Set(Connection, "Upgrade")
+		h.Set(Upgrade, upgrade)
+	}
+}
+
+// headerTokens returns the comma-separated tokens of the given header.
+func headerTokens(h http.Header, key string) []string {
+	var tokens []string
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// headerContainsToken returns true if the given header contains the given token,
+// compared case-insensitively.
+func headerContainsToken(h http.Header, key, token string) bool {
+	for _, t := range headerTokens(h, key) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	cases := []struct {
+		header      http.Header
+		keepUpgrade bool
+		expected    http.Header
+	}{
+		// fixed hop-by-hop headers
+		{
+			http.Header{Connection: {"keep-alive"}, KeepAlive: {"timeout=5"}, ProxyConnection: {"keep-alive"},
+				Te: {"gzip"}, TransferEncoding: {"chunked"}, ProxyAuthorization: {"Basic Zm9v"}, "Accept": {"*/*"}},
+			false,
+			http.Header{"Accept": {"*/*"}},
+		},
+		// connection tokens
+		{
+			http.Header{Connection: {"X-Foo, close", " x-bar "}, "X-Foo": {"1"}, "X-Bar": {"2"}, "X-Baz": {"3"}},
+			false,
+			http.Header{"X-Baz": {"3"}},
+		},
+		// upgrade removed
+		{
+			http.Header{Connection: {"Upgrade"}, Upgrade: {"websocket"}},
+			false,
+			http.Header{},
+		},
+		// upgrade kept
+		{
+			http.Header{Connection: {"keep-alive, Upgrade, X-Foo"}, Upgrade: {"websocket"}, "X-Foo": {"1"}},
+			true,
+			http.Header{Connection: {"Upgrade"}, Upgrade: {"websocket"}},
+		},
+		// upgrade without connection token
+		{
+			http.Header{Upgrade: {"websocket"}},
+			true,
+			http.Header{},
+		},
+	}
+	for _, c := range cases {
+		RemoveHopHeaders(c.header, c.keepUpgrade)
+		st.Expect(t, c.header, c.expected)
+	}
+}
+
+func TestHopHeadersRequest(t *testing.T) {
+	var header http.Header
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL)
+	defer proxy.Close()
+
+	_, _, err := testutils.Get(proxy.URL, testutils.Header(Connection, "X-Foo, X-Forwarded-For, TE"),
+		testutils.Header("X-Foo", "1"), testutils.Header("X-Bar", "2"), testutils.Header(Te, "trailers"))
+	st.Expect(t, err, nil)
+	st.Expect(t, header.Get("X-Foo"), "")
+	st.Expect(t, header.Get("X-Bar"), "2")
+	st.Expect(t, header.Get(Te), "trailers")
+	// forwarding headers cannot be removed by clients
+	st.Expect(t, header.Get(XForwardedFor), "127.0.0.1")
+}
+
+func TestHopHeadersResponse(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(Connection, "X-Internal")
+		w.Header().Set(KeepAlive, "timeout=5")
+		w.Header().Set(ProxyAuthenticate, "Basic")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("X-Public", "value")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(body), "hello")
+	st.Expect(t, re.Header.Get(KeepAlive), "")
+	st.Expect(t, re.Header.Get(ProxyAuthenticate), "")
+	st.Expect(t, re.Header.Get("X-Internal"), "")
+	st.Expect(t, re.Header.Get("X-Public"), "value")
+}
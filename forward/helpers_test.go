@@ -0,0 +1,27 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// newTestProxy starts a new proxy forwarding to the given target URL.
+func newTestProxy(t *testing.T, target string, opts ...OptSetter) *httptest.Server {
+	return testutils.NewHandler(newProxyHandler(t, target, opts...))
+}
+
+// newProxyHandler returns a handler forwarding to the given target URL,
+// keeping the request path and query.
+func newProxyHandler(t *testing.T, target string, opts ...OptSetter) http.HandlerFunc {
+	f, err := New(opts...)
+	st.Expect(t, err, nil)
+	u := testutils.ParseURI(target)
+	return func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		f.ServeHTTP(w, req)
+	}
+}
@@ -0,0 +1,60 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// DefaultTransport stores the transport used by default by the forwarder.
+// It negotiates HTTP/2 with TLS upstream servers via ALPN,
+// falling back to HTTP/1.1 if the upstream server does not support it.
+var DefaultTransport http.RoundTripper = newTransport(nil)
+
+// newTransport creates a new HTTP transport supporting HTTP/2 over TLS,
+// using the given TLS configuration.
+func newTransport(config *tls.Config) *http.Transport {
+	t := &http.Transport{
+		TLSClientConfig:       config,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           defaultDialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	http2.ConfigureTransport(t)
+	return t
+}
+
+// newH2CTransport creates a new HTTP/2 transport talking
+// cleartext HTTP/2 with prior knowledge.
+func newH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return defaultDialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// h2cRoundTripper forwards the cleartext traffic using HTTP/2 with prior knowledge,
+// while the TLS traffic is forwarded using the next round tripper.
+type h2cRoundTripper struct {
+	next http.RoundTripper
+	h2c  http.RoundTripper
+	// grpc limits the HTTP/2 cleartext traffic to gRPC requests.
+	grpc bool
+}
+
+// RoundTrip forwards the request to the upstream server.
+func (rt *h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" && (!rt.grpc || IsGRPCRequest(req)) {
+		return rt.h2c.RoundTrip(req)
+	}
+	return rt.next.RoundTrip(req)
+}
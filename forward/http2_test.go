@@ -0,0 +1,84 @@
+package forward
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestForwardHTTP2TLS(t *testing.T) {
+	var proto string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+		w.Write([]byte("hello"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	transport := newTransport(nil)
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	f, err := New(RoundTripper(transport))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, string(body), "hello")
+	st.Expect(t, proto, "HTTP/2.0")
+}
+
+func TestForwardH2C(t *testing.T) {
+	var proto string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	})
+	srv := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer srv.Close()
+
+	f, err := New(H2C())
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Post(proxy.URL, testutils.Body("hello"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, string(body), "hello")
+	st.Expect(t, proto, "HTTP/2.0")
+}
+
+func TestH2CRoundTripperTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}))
+	defer srv.Close()
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	rt := &h2cRoundTripper{next: transport, h2c: newH2CTransport()}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	res, err := rt.RoundTrip(req)
+	st.Expect(t, err, nil)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	st.Expect(t, string(body), "HTTP/1.1")
+}
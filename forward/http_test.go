@@ -1 +1,213 @@
 package forward
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+	"gopkg.in/vinxi/utils.v0"
+)
+
+func TestForwardResponseTrailers(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("hello"))
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Undeclared", "foo")
+	})
+	defer srv.Close()
+
+	f, err := New()
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	st.Expect(t, err, nil)
+	st.Expect(t, string(body), "hello")
+	st.Expect(t, res.Trailer.Get("X-Checksum"), "abc")
+	st.Expect(t, res.Trailer.Get("X-Undeclared"), "foo")
+}
+
+func TestForwardRequestTrailers(t *testing.T) {
+	var body, checksum, te string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		te = req.Header.Get(Te)
+		buf, _ := ioutil.ReadAll(req.Body)
+		body = string(buf)
+		checksum = req.Trailer.Get("X-Checksum")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", proxy.URL, ioutil.NopCloser(pr))
+	st.Expect(t, err, nil)
+	req.Header.Set(Te, "trailers")
+	req.Trailer = http.Header{"X-Checksum": nil}
+	go func() {
+		io.Copy(pw, strings.NewReader("payload"))
+		req.Trailer.Set("X-Checksum", "abc")
+		pw.Close()
+	}()
+
+	res, err := http.DefaultClient.Do(req)
+	st.Expect(t, err, nil)
+	res.Body.Close()
+	st.Expect(t, res.StatusCode, http.StatusOK)
+	st.Expect(t, body, "payload")
+	st.Expect(t, checksum, "abc")
+	st.Expect(t, te, "trailers")
+}
+
+func TestForwardTimeout(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(Timeout(20 * time.Millisecond))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusGatewayTimeout)
+}
+
+func TestForwardResponseHeaderTimeout(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(ResponseHeaderTimeout(20 * time.Millisecond))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusGatewayTimeout)
+}
+
+func TestForwardResponseHeaderTimeoutSlowUpload(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL, ResponseHeaderTimeout(50*time.Millisecond))
+	defer proxy.Close()
+
+	// the request body takes longer than the timeout to be sent
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(30 * time.Millisecond)
+			pw.Write([]byte("hello"))
+		}
+		pw.Close()
+	}()
+	re, err := http.Post(proxy.URL, "text/plain", pr)
+	st.Expect(t, err, nil)
+	defer re.Body.Close()
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	body, _ := ioutil.ReadAll(re.Body)
+	st.Expect(t, string(body), "hellohellohellohello")
+}
+
+func TestForwardClientCancel(t *testing.T) {
+	cancelled := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer srv.Close()
+
+	buf := &bytes.Buffer{}
+	f, err := New(Logger(utils.NewFileLogger(buf, utils.INFO)))
+	st.Expect(t, err, nil)
+
+	done := make(chan struct{})
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		defer close(done)
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	_, err = http.DefaultClient.Do(req.WithContext(ctx))
+	st.Reject(t, err, nil)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("upstream request was not cancelled")
+	}
+	<-done
+	st.Expect(t, strings.Contains(buf.String(), "Client cancelled"), true)
+}
+
+func TestForwardAbortedResponseBody(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		// the upstream connection is closed in the middle of the chunked body
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+		conn.Close()
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL)
+	defer proxy.Close()
+
+	re, err := http.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	body, err := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	// the client notices the response is incomplete
+	st.Reject(t, err, nil)
+	st.Expect(t, string(body), "hello")
+}
@@ -0,0 +1,54 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// ErrRequestTooLarge is returned when the request body exceeds the configured maximum size.
+var ErrRequestTooLarge = errors.New("forward: request body too large")
+
+// ErrInvalidRequestBody is returned when the request body cannot be read, such as
+// a compressed body which cannot be decoded in order to be transformed.
+var ErrInvalidRequestBody = errors.New("forward: invalid request body")
+
+// ErrResponseTooLarge is returned when the upstream response body exceeds the configured maximum size.
+var ErrResponseTooLarge = errors.New("forward: response body too large")
+
+// limitedReader reads up to max bytes from the underlying reader,
+// failing with the given error once the limit is exceeded.
+type limitedReader struct {
+	io.ReadCloser
+	max      int64
+	read     int64
+	err      error
+	exceeded int32
+}
+
+// newLimitedReader returns a reader failing with err after reading more than max bytes.
+func newLimitedReader(r io.ReadCloser, max int64, err error) *limitedReader {
+	return &limitedReader{ReadCloser: r, max: max, err: err}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.read > r.max {
+		return 0, r.err
+	}
+	// read one more byte than allowed to detect oversized bodies
+	if remaining := r.max - r.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if r.read > r.max {
+		atomic.StoreInt32(&r.exceeded, 1)
+		return n - int(r.read-r.max), r.err
+	}
+	return n, err
+}
+
+// tooLarge returns true if the reader exceeded the limit.
+func (r *limitedReader) tooLarge() bool {
+	return atomic.LoadInt32(&r.exceeded) == 1
+}
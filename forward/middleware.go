@@ -6,14 +6,18 @@ import (
 )
 
 // To returns an http.HandlerFunc that forwards the incoming request to
-// the given URI server.
-func To(uri string) func(w http.ResponseWriter, r *http.Request) {
+// the given URI server. The URI path, if any, is joined with the incoming request path,
+// such as "http://svc/api/v2" forwarding "/users" to "/api/v2/users".
+// Additional options, such as StripPrefix or RewritePath, can be given.
+func To(uri string, opts ...OptSetter) func(w http.ResponseWriter, r *http.Request) {
 	parsedURL, err := url.Parse(uri)
 	if err != nil {
 		panic(err)
 	}
 
-	fwd, err := New(PassHostHeader(true))
+	// the target base path is joined after any other path rewrite
+	opts = append([]OptSetter{PassHostHeader(true)}, opts...)
+	fwd, err := New(append(opts, PathPrefix(parsedURL.Path))...)
 	if err != nil {
 		panic(err)
 	}
@@ -27,3 +31,13 @@ func To(uri string) func(w http.ResponseWriter, r *http.Request) {
 		fwd.ServeHTTP(w, r)
 	}
 }
+
+// ToMany returns an http.HandlerFunc that balances the incoming requests
+// across the upstream servers of the given balancer.
+func ToMany(b *Balancer) func(w http.ResponseWriter, r *http.Request) {
+	fwd, err := New(Balance(b))
+	if err != nil {
+		panic(err)
+	}
+	return fwd.ServeHTTP
+}
@@ -0,0 +1,85 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+	"golang.org/x/net/websocket"
+)
+
+func TestRewritePath(t *testing.T) {
+	cases := []struct {
+		opts     []OptSetter
+		path     string
+		expected string
+	}{
+		{[]OptSetter{PathPrefix("/api/v2")}, "/users", "/api/v2/users"},
+		{[]OptSetter{PathPrefix("/api/v2/")}, "/", "/api/v2/"},
+		{[]OptSetter{PathPrefix("/")}, "/users", "/users"},
+		{[]OptSetter{StripPrefix("/users")}, "/users/123", "/123"},
+		{[]OptSetter{StripPrefix("/users")}, "/users", "/"},
+		{[]OptSetter{StripPrefix("/users")}, "/groups/1", "/groups/1"},
+		{[]OptSetter{StripPrefix("/users")}, "/usersettings", "/usersettings"},
+		{[]OptSetter{StripPrefix("/users/")}, "/users/123", "/123"},
+		{[]OptSetter{RewritePath(`^/users/(\w+)/posts`, "/posts/$1")}, "/users/tom/posts", "/posts/tom"},
+		{[]OptSetter{StripPrefix("/users"), PathPrefix("/api")}, "/users/a%2Fb", "/api/a%2Fb"},
+	}
+	for _, c := range cases {
+		f, err := New(c.opts...)
+		st.Expect(t, err, nil)
+		path, _ := url.PathUnescape(c.path)
+		u := &url.URL{Path: path, RawPath: c.path}
+		rewritePath(u, f.httpForwarder.paths)
+		st.Expect(t, u.EscapedPath(), c.expected)
+	}
+
+	_, err := New(RewritePath("(", ""))
+	st.Reject(t, err, nil)
+}
+
+func TestToPathPrefix(t *testing.T) {
+	var uri string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		uri = req.RequestURI
+	})
+	defer srv.Close()
+
+	proxy := testutils.NewHandler(To(srv.URL+"/api/v2", StripPrefix("/users")))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL + "/users/123?fields=name")
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, uri, "/api/v2/123?fields=name")
+
+	// requests without path rewrites keep the original request URI
+	proxy = testutils.NewHandler(To(srv.URL))
+	defer proxy.Close()
+	_, _, err = testutils.Get(proxy.URL + "/a%2Fb?c=%20")
+	st.Expect(t, err, nil)
+	st.Expect(t, uri, "/a%2Fb?c=%20")
+}
+
+func TestWebsocketPathPrefix(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/api/ws", websocket.Handler(func(conn *websocket.Conn) {
+		conn.Write([]byte("ok"))
+		conn.Close()
+	}))
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	proxy := testutils.NewHandler(To(srv.URL+"/api", StripPrefix("/chat")))
+	defer proxy.Close()
+
+	conn, err := websocket.Dial("ws://"+proxy.Listener.Addr().String()+"/chat/ws", "", "http://localhost")
+	st.Expect(t, err, nil)
+	msg := make([]byte, 2)
+	_, err = conn.Read(msg)
+	conn.Close()
+	st.Expect(t, err, nil)
+	st.Expect(t, string(msg), "ok")
+}
@@ -0,0 +1,96 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestQueryRewriter(t *testing.T) {
+	rw := &QueryRewriter{
+		Rename: map[string]string{":id": "id", "q": "search", "search": "query"},
+		Remove: []string{"debug"},
+		Set:    map[string]string{"version": "2"},
+		Add:    map[string]string{"tag": "proxy"},
+	}
+	u := &url.URL{RawQuery: "%3Aid=123&%3Aname=tom&q=foo&debug=1&version=1&tag=a"}
+	rewriteQuery(u, []*QueryRewriter{rw})
+	st.Expect(t, u.RawQuery, "id=123&search=foo&version=2&tag=a&tag=proxy")
+
+	// router captures are stripped without query rewriters
+	u = &url.URL{RawQuery: "%3Aid=123&"}
+	rewriteQuery(u, nil)
+	st.Expect(t, u.RawQuery, "")
+}
+
+func TestRewriteQuery(t *testing.T) {
+	rw := &QueryRewriter{
+		Rename: map[string]string{"q": "search"},
+		Remove: []string{"debug"},
+		Set:    map[string]string{"version": "2", "lang": "en"},
+		Add:    map[string]string{"tag": "proxy"},
+	}
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{"", "lang=en&version=2&tag=proxy"},
+		{"b=%20&a=1;2&tag=a+b", "b=%20&a=1;2&tag=a+b&lang=en&version=2&tag=proxy"},
+		{"%3Aid=123&q=a%2Fb&debug&z=%7E&version=1&version=3", "search=a%2Fb&z=%7E&version=2&lang=en&tag=proxy"},
+	}
+	for _, c := range cases {
+		u := &url.URL{RawQuery: c.query}
+		rewriteQuery(u, []*QueryRewriter{rw})
+		st.Expect(t, u.RawQuery, c.expected)
+	}
+
+	// queries without affected parameters are left unchanged
+	u := &url.URL{RawQuery: "b=%20&a=1&&c&b=%7e"}
+	rewriteQuery(u, []*QueryRewriter{{Remove: []string{"d"}, Rename: map[string]string{"e": "f"}}})
+	st.Expect(t, u.RawQuery, "b=%20&a=1&&c&b=%7e")
+}
+
+func TestForwardModifiedURL(t *testing.T) {
+	var uri string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		uri = req.RequestURI
+	})
+	defer srv.Close()
+
+	fwd := To(srv.URL, RewriteQuery(&QueryRewriter{Remove: []string{"token"}}))
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		// simulates the params captured by the router and other query changes
+		req.URL.RawQuery = url.Values{":id": {"123"}}.Encode() + "&" + req.URL.RawQuery + "&page=2"
+		fwd(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL + "/users/123?token=secret&sort=name")
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, uri, "/users/123?sort=name&page=2")
+}
+
+func TestForwardModifiedURLWithoutRewriters(t *testing.T) {
+	var uri string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		uri = req.RequestURI
+	})
+	defer srv.Close()
+
+	fwd := To(srv.URL)
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		// path and query changes made by previous middleware reach the upstream server
+		req.URL.Path = "/v2" + req.URL.Path
+		req.URL.RawQuery += "&b=2"
+		fwd(w, req)
+	})
+	defer proxy.Close()
+
+	_, _, err := testutils.Get(proxy.URL + "/foo?a=%201")
+	st.Expect(t, err, nil)
+	st.Expect(t, uri, "/v2/foo?a=%201&b=2")
+}
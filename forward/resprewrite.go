@@ -0,0 +1,151 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/vinxi/utils.v0"
+)
+
+// RespRewriter can alter the upstream response headers
+// before they are copied to the client response.
+type RespRewriter interface {
+	Rewrite(res *http.Response, req *http.Request)
+}
+
+// RespRewriterFunc is an adapter to use ordinary functions as RespRewriter.
+type RespRewriterFunc func(res *http.Response, req *http.Request)
+
+// Rewrite calls f(res, req).
+func (f RespRewriterFunc) Rewrite(res *http.Response, req *http.Request) {
+	f(res, req)
+}
+
+// LocationRewriter rewrites the Location and Content-Location headers
+// pointing to the upstream server, so they point to the proxy instead.
+type LocationRewriter struct {
+	// Hosts defines additional upstream host names to rewrite,
+	// such as the public names known by the upstream servers.
+	Hosts []string
+}
+
+// Rewrite rewrites the response location headers.
+func (rw *LocationRewriter) Rewrite(res *http.Response, req *http.Request) {
+	for _, key := range []string{Location, ContentLocation} {
+		if value := res.Header.Get(key); value != "" {
+			res.Header.Set(key, rw.rewrite(value, res, req))
+		}
+	}
+}
+
+// rewrite returns the given location pointing to the proxy,
+// if it points to the upstream server.
+func (rw *LocationRewriter) rewrite(location string, res *http.Response, req *http.Request) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || !rw.upstream(u.Host, res) {
+		return location
+	}
+	u.Host = req.Host
+	if req.TLS != nil {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+	return u.String()
+}
+
+// upstream returns true if the given host belongs to the upstream server.
+func (rw *LocationRewriter) upstream(host string, res *http.Response) bool {
+	if res.Request != nil && strings.EqualFold(host, res.Request.URL.Host) {
+		return true
+	}
+	for _, h := range rw.Hosts {
+		if strings.EqualFold(host, h) || strings.EqualFold(hostname(host), h) {
+			return true
+		}
+	}
+	return false
+}
+
+// CookieRewriter rewrites the Domain and Path attributes of the upstream cookies.
+type CookieRewriter struct {
+	// Domains maps the upstream cookie domains to the proxy domains.
+	// Mapping a domain to an empty string removes the Domain attribute.
+	Domains map[string]string
+	// Paths maps the upstream cookie path prefixes to the proxy path prefixes.
+	Paths map[string]string
+}
+
+// Rewrite rewrites the response Set-Cookie headers.
+func (rw *CookieRewriter) Rewrite(res *http.Response, req *http.Request) {
+	cookies := res.Header[SetCookie]
+	for i, cookie := range cookies {
+		cookies[i] = rw.rewrite(cookie)
+	}
+}
+
+// rewrite rewrites the attributes of the given Set-Cookie header value,
+// keeping any other attribute as it is.
+func (rw *CookieRewriter) rewrite(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	attrs := parts[:1]
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		name, value := attr, ""
+		if i := strings.Index(attr, "="); i >= 0 {
+			name, value = attr[:i], attr[i+1:]
+		}
+
+		switch strings.ToLower(name) {
+		case "domain":
+			domain, ok := rw.domain(value)
+			if ok && domain == "" {
+				continue
+			}
+			if ok {
+				part = " " + name + "=" + domain
+			}
+		case "path":
+			if prefix := rw.pathPrefix(value); prefix != "" {
+				part = " " + name + "=" + rw.Paths[prefix] + strings.TrimPrefix(value, prefix)
+			}
+		}
+		attrs = append(attrs, part)
+	}
+	return strings.Join(attrs, ";")
+}
+
+// domain returns the proxy domain for the given upstream cookie domain.
+// Domains are matched case-insensitively, ignoring the leading dot.
+func (rw *CookieRewriter) domain(value string) (string, bool) {
+	value = strings.TrimPrefix(value, ".")
+	for upstream, domain := range rw.Domains {
+		if strings.EqualFold(strings.TrimPrefix(upstream, "."), value) {
+			return domain, true
+		}
+	}
+	return "", false
+}
+
+// pathPrefix returns the longest configured prefix of the given cookie path.
+func (rw *CookieRewriter) pathPrefix(path string) string {
+	match := ""
+	for prefix := range rw.Paths {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	return match
+}
+
+// HeaderRemover removes the given headers from the upstream responses,
+// such as headers exposing the upstream server details.
+type HeaderRemover struct {
+	Headers []string
+}
+
+// Rewrite removes the configured headers.
+func (rw *HeaderRemover) Rewrite(res *http.Response, req *http.Request) {
+	utils.RemoveHeaders(res.Header, rw.Headers...)
+}
@@ -0,0 +1,86 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestLocationRewriter(t *testing.T) {
+	cases := []struct {
+		location string
+		expected string
+	}{
+		{"http://backend:8080/login?next=/", "http://proxy.com/login?next=/"},
+		{"http://internal.local/foo", "http://proxy.com/foo"},
+		{"http://other.com/foo", "http://other.com/foo"},
+		{"/relative", "/relative"},
+	}
+
+	rw := &LocationRewriter{Hosts: []string{"internal.local"}}
+	for _, c := range cases {
+		res := &http.Response{
+			Header:  http.Header{Location: {c.location}, ContentLocation: {c.location}},
+			Request: &http.Request{URL: &url.URL{Scheme: "http", Host: "backend:8080"}},
+		}
+		rw.Rewrite(res, &http.Request{Host: "proxy.com"})
+		st.Expect(t, res.Header.Get(Location), c.expected)
+		st.Expect(t, res.Header.Get(ContentLocation), c.expected)
+	}
+}
+
+func TestCookieRewriter(t *testing.T) {
+	cases := []struct {
+		cookie   string
+		expected string
+	}{
+		{"id=1; Domain=backend.local; Path=/app/admin; HttpOnly", "id=1; Domain=proxy.com; Path=/admin; HttpOnly"},
+		{"id=1; domain=.Backend.local; path=/app", "id=1; domain=proxy.com; path=/"},
+		{"id=1; Domain=hidden.local; Secure", "id=1; Secure"},
+		{"id=1; Domain=other.com; Path=/other", "id=1; Domain=other.com; Path=/other"},
+	}
+
+	rw := &CookieRewriter{
+		Domains: map[string]string{"backend.local": "proxy.com", "hidden.local": ""},
+		Paths:   map[string]string{"/app": "/", "/app/": "/"},
+	}
+	for _, c := range cases {
+		res := &http.Response{Header: http.Header{SetCookie: {c.cookie}}}
+		rw.Rewrite(res, nil)
+		st.Expect(t, res.Header.Get(SetCookie), c.expected)
+	}
+}
+
+func TestResponseRewriter(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "backend/1.0")
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set(Location, "http://"+req.Host+"/next")
+		w.WriteHeader(http.StatusFound)
+	})
+	defer srv.Close()
+
+	var method string
+	proxy := newTestProxy(t, srv.URL,
+		ResponseRewriter(&HeaderRemover{Headers: []string{"Server", "X-Powered-By"}}),
+		ResponseRewriter(&LocationRewriter{}),
+		ResponseRewriter(RespRewriterFunc(func(res *http.Response, req *http.Request) {
+			method = req.Method
+		})))
+	defer proxy.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	re, err := client.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	re.Body.Close()
+	st.Expect(t, re.StatusCode, http.StatusFound)
+	st.Expect(t, re.Header.Get("Server"), "")
+	st.Expect(t, re.Header.Get("X-Powered-By"), "")
+	st.Expect(t, re.Header.Get(Location), proxy.URL+"/next")
+	st.Expect(t, method, "GET")
+}
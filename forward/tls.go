@@ -0,0 +1,301 @@
+package forward
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrPinMismatch is returned when no upstream certificate matches the configured pins.
+var ErrPinMismatch = errors.New("forward: upstream certificate does not match the pinned keys")
+
+// TLSOptions defines the TLS options used to connect to the upstream servers,
+// both for HTTP and secure websocket forwarding.
+type TLSOptions struct {
+	// CertFile and KeyFile define the PEM encoded client certificate
+	// presented to the upstream servers requesting mutual TLS.
+	CertFile string
+	KeyFile  string
+	// CAFiles defines the PEM encoded CA bundle files used to verify
+	// the upstream certificates. The system roots are used if empty.
+	CAFiles []string
+	// ServerName overrides the server name used for SNI and to verify
+	// the upstream certificates. Defaults to the upstream host name.
+	ServerName string
+	// InsecureSkipVerify disables the upstream certificate verification.
+	// Pinned keys are still checked against the upstream certificate.
+	InsecureSkipVerify bool
+	// Pins defines the base64 encoded SHA-256 hashes of the accepted upstream
+	// public keys (SPKI). Any certificate of the verified chain can match.
+	Pins []string
+	// ReloadInterval defines how often the certificate files are checked
+	// for changes. Defaults to 10 seconds.
+	ReloadInterval time.Duration
+}
+
+// upstreamTLS builds the TLS configuration for the upstream connections,
+// reloading the certificate files once they change.
+type upstreamTLS struct {
+	options TLSOptions
+	pins    map[string]bool
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modTimes map[string]time.Time
+	checked  time.Time
+}
+
+// newUpstreamTLS creates a new upstream TLS configuration, loading the certificate files.
+func newUpstreamTLS(options TLSOptions) (*upstreamTLS, error) {
+	if options.ReloadInterval == 0 {
+		options.ReloadInterval = 10 * time.Second
+	}
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, errors.New("forward: both client certificate and key files are required")
+	}
+
+	u := &upstreamTLS{options: options, pins: make(map[string]bool)}
+	for _, pin := range options.Pins {
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("forward: invalid SPKI pin: %s", pin)
+		}
+		u.pins[pin] = true
+	}
+	if err := u.load(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// files returns the certificate files to watch.
+func (u *upstreamTLS) files() []string {
+	files := append([]string{}, u.options.CAFiles...)
+	if u.options.CertFile != "" {
+		files = append(files, u.options.CertFile, u.options.KeyFile)
+	}
+	return files
+}
+
+// load loads the certificate files.
+func (u *upstreamTLS) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range u.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if u.options.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(u.options.CertFile, u.options.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	var roots *x509.CertPool
+	if len(u.options.CAFiles) > 0 {
+		roots = x509.NewCertPool()
+		for _, file := range u.options.CAFiles {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if !roots.AppendCertsFromPEM(data) {
+				return fmt.Errorf("forward: no certificates found in CA file: %s", file)
+			}
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.cert = cert
+	u.roots = roots
+	u.modTimes = modTimes
+	u.checked = time.Now()
+	return nil
+}
+
+// reload reloads the certificate files if any of them changed since the last check.
+// The current certificates are kept if the files cannot be loaded, such as
+// while they are being replaced.
+func (u *upstreamTLS) reload() {
+	u.mu.Lock()
+	if time.Since(u.checked) < u.options.ReloadInterval {
+		u.mu.Unlock()
+		return
+	}
+	u.checked = time.Now()
+	modTimes := u.modTimes
+	u.mu.Unlock()
+
+	for _, file := range u.files() {
+		if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(modTimes[file]) {
+			u.load()
+			return
+		}
+	}
+}
+
+// state returns the current client certificate and CA roots.
+func (u *upstreamTLS) state() (*tls.Certificate, *x509.CertPool) {
+	u.reload()
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.cert, u.roots
+}
+
+// config returns the TLS configuration used to connect to the given upstream host.
+// An empty host leaves the server name to the transport, which sets it per upstream host.
+func (u *upstreamTLS) config(host string) *tls.Config {
+	_, roots := u.state()
+	serverName := u.options.ServerName
+	if serverName == "" && host != "" {
+		serverName = hostname(host)
+	}
+	return &tls.Config{
+		ServerName:           serverName,
+		RootCAs:              roots,
+		InsecureSkipVerify:   u.options.InsecureSkipVerify,
+		GetClientCertificate: u.clientCertificate,
+		VerifyConnection:     u.verifyPins,
+	}
+}
+
+// clientCertificate returns the client certificate presented to the upstream server.
+func (u *upstreamTLS) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert, _ := u.state(); cert != nil {
+		return cert, nil
+	}
+	// no certificate is sent if none is configured
+	return &tls.Certificate{}, nil
+}
+
+// verifyPins checks the verified upstream certificates against the pinned keys, if any.
+func (u *upstreamTLS) verifyPins(cs tls.ConnectionState) error {
+	if len(u.pins) == 0 {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("forward: no upstream certificate")
+	}
+
+	// only the leaf certificate can be trusted without verification
+	candidates := cs.PeerCertificates[:1]
+	if !u.options.InsecureSkipVerify {
+		candidates = nil
+		for _, chain := range cs.VerifiedChains {
+			candidates = append(candidates, chain...)
+		}
+	}
+	for _, cert := range candidates {
+		if u.pins[SPKIPin(cert)] {
+			return nil
+		}
+	}
+	return ErrPinMismatch
+}
+
+// SPKIPin returns the base64 encoded SHA-256 hash of the certificate public key,
+// as expected by TLSOptions.Pins.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hostname returns the host name of the given host, removing the port if present.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// tlsConfigs stores the upstream TLS configurations, by upstream host.
+type tlsConfigs struct {
+	def   *upstreamTLS
+	hosts map[string]*upstreamTLS
+}
+
+// lookup returns the TLS configuration for the given upstream host,
+// matching the host with and without port before the default configuration.
+func (c *tlsConfigs) lookup(host string) *upstreamTLS {
+	if u, ok := c.hosts[host]; ok {
+		return u
+	}
+	if u, ok := c.hosts[hostname(host)]; ok {
+		return u
+	}
+	return c.def
+}
+
+// config returns the TLS configuration used to connect to the given upstream host.
+func (c *tlsConfigs) config(host string) *tls.Config {
+	if u := c.lookup(host); u != nil {
+		return u.config(host)
+	}
+	return &tls.Config{ServerName: hostname(host)}
+}
+
+// tlsRoundTripper forwards the traffic using a transport per upstream TLS configuration,
+// either the default or a per-host one, so upstream hosts sharing a configuration
+// share the transport and its connection pool.
+type tlsRoundTripper struct {
+	configs    *tlsConfigs
+	mu         sync.Mutex
+	transports map[*upstreamTLS]*tlsTransport
+}
+
+// tlsTransport stores a transport with the CA roots it verifies the upstream certificates with.
+type tlsTransport struct {
+	*http.Transport
+	roots *x509.CertPool
+}
+
+// RoundTrip forwards the request to the upstream server.
+func (rt *tlsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return rt.transport(req.URL.Host).RoundTrip(req)
+}
+
+// transport returns the transport for the TLS configuration of the given upstream host.
+// The transport is replaced once the CA roots are reloaded.
+func (rt *tlsRoundTripper) transport(host string) http.RoundTripper {
+	u := rt.configs.lookup(host)
+	var roots *x509.CertPool
+	if u != nil {
+		_, roots = u.state()
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.transports == nil {
+		rt.transports = make(map[*upstreamTLS]*tlsTransport)
+	}
+	t, ok := rt.transports[u]
+	if ok && t.roots == roots {
+		return t
+	}
+	if ok {
+		t.CloseIdleConnections()
+	}
+	config := &tls.Config{}
+	if u != nil {
+		config = u.config("")
+	}
+	t = &tlsTransport{newTransport(config), roots}
+	rt.transports[u] = t
+	return t
+}
@@ -0,0 +1,260 @@
+package forward
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestReplace(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected string
+	}{
+		{"http://backend.local/foo", "https://proxy.com/foo"},
+		{"a http://backend.local b http://backend.local", "a https://proxy.com b https://proxy.com"},
+		{"http://backend.loca", "http://backend.loca"},
+		{"", ""},
+	}
+	rw := Replace("http://backend.local", "https://proxy.com")
+	for _, c := range cases {
+		// single byte reads split every occurrence across reads
+		data, err := ioutil.ReadAll(rw.Transform(nil, iotest.OneByteReader(strings.NewReader(c.body))))
+		st.Expect(t, err, nil)
+		st.Expect(t, string(data), c.expected)
+	}
+}
+
+func TestBodyTransformMatches(t *testing.T) {
+	transform := &BodyTransform{ContentTypes: []string{"text/*", "application/json"}}
+	st.Expect(t, transform.matches("text/html; charset=utf-8"), true)
+	st.Expect(t, transform.matches("application/json"), true)
+	st.Expect(t, transform.matches("application/octet-stream"), false)
+	st.Expect(t, transform.matches(""), false)
+	st.Expect(t, (&BodyTransform{}).matches(""), true)
+}
+
+func TestResponseTransformGzip(t *testing.T) {
+	var acceptEncoding string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		acceptEncoding = req.Header.Get(AcceptEncoding)
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(`<a href="http://backend.local/foo">foo</a>`))
+		gz.Close()
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set(ContentEncoding, "gzip")
+		w.Header().Set("Etag", `"123"`)
+		w.Write(buf.Bytes())
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL, ResponseTransform(BodyTransform{
+		ContentTypes: []string{"text/html"},
+		Transformers: []BodyTransformer{Replace("backend.local", "proxy.com")},
+	}))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header(AcceptEncoding, "zstd, gzip;q=0.8"))
+	st.Expect(t, err, nil)
+	st.Expect(t, acceptEncoding, "gzip;q=0.8")
+	st.Expect(t, re.ContentLength, int64(-1))
+	st.Expect(t, re.Header.Get(ContentEncoding), "gzip")
+	st.Expect(t, re.Header.Get("Etag"), `W/"123"`)
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	st.Expect(t, err, nil)
+	data, err := ioutil.ReadAll(gz)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(data), `<a href="http://proxy.com/foo">foo</a>`)
+}
+
+func TestResponseTransformRawDeflate(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		fw.Write([]byte("hello backend"))
+		fw.Close()
+		w.Header().Set(ContentEncoding, "deflate")
+		w.Write(buf.Bytes())
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL, ResponseTransform(BodyTransform{
+		Transformers: []BodyTransformer{Replace("backend", "proxy")},
+	}))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header(AcceptEncoding, "deflate"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.Header.Get(ContentEncoding), "deflate")
+	decoded, err := newDecoder(bytes.NewReader(body), "deflate")
+	st.Expect(t, err, nil)
+	data, _ := ioutil.ReadAll(decoded)
+	st.Expect(t, string(data), "hello proxy")
+}
+
+func TestTransformBrotli(t *testing.T) {
+	var received string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(brotli.NewReader(req.Body))
+		received = string(data)
+		bw := brotli.NewWriter(w)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set(ContentEncoding, "br")
+		bw.Write([]byte("hello backend"))
+		bw.Close()
+	})
+	defer srv.Close()
+
+	transform := BodyTransform{Transformers: []BodyTransformer{Replace("backend", "proxy")}}
+	proxy := newTestProxy(t, srv.URL, RequestTransform(transform), ResponseTransform(transform))
+	defer proxy.Close()
+
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	bw.Write([]byte("hello proxy backend"))
+	bw.Close()
+	re, body, err := testutils.Post(proxy.URL, testutils.Body(buf.String()),
+		testutils.Header(ContentEncoding, "br"), testutils.Header(AcceptEncoding, "br"))
+	st.Expect(t, err, nil)
+	st.Expect(t, received, "hello proxy proxy")
+	st.Expect(t, re.Header.Get(ContentEncoding), "br")
+	data, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+	st.Expect(t, err, nil)
+	st.Expect(t, string(data), "hello proxy")
+}
+
+func TestRequestTransformInvalidBody(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+	})
+	defer srv.Close()
+
+	b, err := NewBalancer(RoundRobin(), srv.URL)
+	st.Expect(t, err, nil)
+	NewHealthChecker(b, HealthCheck{Passive: true, MaxFails: 3, EjectDuration: time.Minute})
+	breaker := NewBreaker(BreakerOptions{MinRequests: 3, ErrorRatio: 0.5})
+
+	f, err := New(Balance(b), CircuitBreaker(breaker), RequestTransform(BodyTransform{
+		Transformers: []BodyTransformer{Replace("proxy", "backend")},
+	}))
+	st.Expect(t, err, nil)
+	proxy := testutils.NewHandler(f.ServeHTTP)
+	defer proxy.Close()
+
+	// malformed compressed bodies are client errors, kept out of the breaker and health checks
+	for i := 0; i < 3; i++ {
+		re, _, err := testutils.Post(proxy.URL, testutils.Body("not gzip"), testutils.Header(ContentEncoding, "gzip"))
+		st.Expect(t, err, nil)
+		st.Expect(t, re.StatusCode, http.StatusBadRequest)
+	}
+	st.Expect(t, breaker.State(), BreakerClosed)
+	st.Expect(t, b.Health()[0].Fails, 0)
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+}
+
+func TestResponseTransformSkipped(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("backend"))
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL, ResponseTransform(BodyTransform{
+		ContentTypes: []string{"application/octet-stream"},
+		Transformers: []BodyTransformer{Replace("backend", "proxy")},
+	}), ResponseTransform(BodyTransform{
+		ContentTypes: []string{"text/html"},
+		Transformers: []BodyTransformer{Replace("backend", "other")},
+	}))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.ContentLength, int64(-1))
+	st.Expect(t, string(body), "proxy")
+
+	re, body, err = testutils.Get(proxy.URL, testutils.Header(AcceptEncoding, "zstd"))
+	st.Expect(t, err, nil)
+	st.Expect(t, string(body), "proxy")
+}
+
+func TestTransformUnsupportedEncoding(t *testing.T) {
+	var requests int
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+		w.Header().Set(ContentEncoding, "zstd")
+		w.Write([]byte("backend"))
+	})
+	defer srv.Close()
+
+	transform := BodyTransform{
+		ContentTypes: []string{"text/html"},
+		Transformers: []BodyTransformer{Replace("backend", "proxy")},
+	}
+	proxy := newTestProxy(t, srv.URL, RequestTransform(transform), ResponseTransform(transform))
+	defer proxy.Close()
+
+	// matching requests are rejected before reaching the upstream server
+	re, _, err := testutils.Post(proxy.URL, testutils.Body("backend"),
+		testutils.Header("Content-Type", "text/html"), testutils.Header(ContentEncoding, "zstd"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusUnsupportedMediaType)
+	st.Expect(t, requests, 0)
+
+	// matching responses are replaced by an error
+	re, _, err = testutils.Get(proxy.URL, testutils.Header("Content-Type", "text/html"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusBadGateway)
+	st.Expect(t, requests, 1)
+
+	// bodies not matching any transform are forwarded as they are
+	re, body, err := testutils.Post(proxy.URL, testutils.Body("backend"),
+		testutils.Header("Content-Type", "text/plain"), testutils.Header(ContentEncoding, "zstd"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, re.Header.Get(ContentEncoding), "zstd")
+	st.Expect(t, string(body), "backend")
+}
+
+func TestRequestTransform(t *testing.T) {
+	var body string
+	var contentLength int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		body, contentLength = string(data), req.ContentLength
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL, RequestTransform(BodyTransform{
+		ContentTypes: []string{"application/json"},
+		Transformers: []BodyTransformer{Replace("proxy.com", "backend.local")},
+	}))
+	defer proxy.Close()
+
+	_, _, err := testutils.Post(proxy.URL, testutils.Body(`{"url":"http://proxy.com"}`),
+		testutils.Header("Content-Type", "application/json"))
+	st.Expect(t, err, nil)
+	st.Expect(t, body, `{"url":"http://backend.local"}`)
+	st.Expect(t, contentLength, int64(-1))
+
+	_, _, err = testutils.Post(proxy.URL, testutils.Body(`proxy.com`), testutils.Header("Content-Type", "text/plain"))
+	st.Expect(t, err, nil)
+	st.Expect(t, body, `proxy.com`)
+	st.Expect(t, contentLength, int64(9))
+}
@@ -0,0 +1,228 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTunnelNotFound is returned when closing an unknown websocket tunnel.
+var ErrTunnelNotFound = errors.New("forward: websocket tunnel not found")
+
+// errTunnelDrained is returned when a tunnel is forcibly closed while draining.
+var errTunnelDrained = errors.New("websocket tunnel drain timeout exceeded")
+
+// drainPollInterval defines how often the active tunnels are checked while draining.
+var drainPollInterval = 50 * time.Millisecond
+
+// TunnelStats represents the metrics of a websocket tunnel.
+type TunnelStats struct {
+	ID         uint64        `json:"id"`
+	URL        string        `json:"url"`
+	Upstream   string        `json:"upstream"`
+	RemoteAddr string        `json:"remoteAddr"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration"`
+	// BytesIn stores the number of bytes received from the client.
+	BytesIn int64 `json:"bytesIn"`
+	// BytesOut stores the number of bytes received from the upstream server.
+	BytesOut int64 `json:"bytesOut"`
+	// CloseCode stores the status code of the first close frame, if any.
+	CloseCode int `json:"closeCode,omitempty"`
+	// Error stores the error that ended the tunnel, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Tunnels keeps track of the active websocket tunnels,
+// allowing to close them gracefully.
+type Tunnels struct {
+	mu       sync.Mutex
+	active   map[uint64]*tunnel
+	draining int
+
+	// OnClose is called with the final metrics of every closed tunnel.
+	OnClose func(TunnelStats)
+}
+
+// DefaultTunnels stores the tunnels registry used by default by the forwarders.
+var DefaultTunnels = NewTunnels()
+
+// NewTunnels creates a new websocket tunnels registry.
+func NewTunnels() *Tunnels {
+	return &Tunnels{active: make(map[uint64]*tunnel)}
+}
+
+// tunnelsContextKey is the request context key storing the tunnels registry.
+type tunnelsContextKey struct{}
+
+// WithTunnels returns a copy of the given request context storing the given tunnels registry,
+// used by the forwarders without a registry of their own, such as the ones of a server.
+func WithTunnels(ctx context.Context, ts *Tunnels) context.Context {
+	return context.WithValue(ctx, tunnelsContextKey{}, ts)
+}
+
+// Len returns the number of active tunnels.
+func (ts *Tunnels) Len() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.active)
+}
+
+// Active returns the metrics of the active tunnels, sorted by ID.
+func (ts *Tunnels) Active() []TunnelStats {
+	tunnels := ts.tunnels()
+	stats := make([]TunnelStats, len(tunnels))
+	for i, t := range tunnels {
+		stats[i] = t.stats()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
+
+// Close gracefully closes the tunnel with the given ID, sending a close frame
+// with the given status code to both the client and the upstream server.
+func (ts *Tunnels) Close(id uint64, code int) error {
+	ts.mu.Lock()
+	t, ok := ts.active[id]
+	ts.mu.Unlock()
+	if !ok {
+		return ErrTunnelNotFound
+	}
+	t.shutdown(code)
+	return nil
+}
+
+// Drain gracefully closes all the active tunnels, sending a going away close frame
+// to both the client and the upstream server, and waits until the peers close them.
+// Once the context is done, the remaining tunnels are forcibly closed.
+// Tunnels opened while draining are gracefully closed right away,
+// while the registry accepts new tunnels again once Drain returns.
+func (ts *Tunnels) Drain(ctx context.Context) error {
+	ts.mu.Lock()
+	ts.draining++
+	ts.mu.Unlock()
+	defer func() {
+		ts.mu.Lock()
+		ts.draining--
+		ts.mu.Unlock()
+	}()
+
+	for _, t := range ts.tunnels() {
+		t.shutdown(CloseGoingAway)
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if ts.Len() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, t := range ts.tunnels() {
+				t.close(errTunnelDrained)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tunnels returns the active tunnels.
+func (ts *Tunnels) tunnels() []*tunnel {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tunnels := make([]*tunnel, 0, len(ts.active))
+	for _, t := range ts.active {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// add registers the given tunnel.
+func (ts *Tunnels) add(t *tunnel) {
+	ts.mu.Lock()
+	ts.active[t.id] = t
+	draining := ts.draining > 0
+	ts.mu.Unlock()
+	if draining {
+		t.shutdown(CloseGoingAway)
+	}
+}
+
+// remove unregisters the given tunnel, reporting its final metrics.
+func (ts *Tunnels) remove(t *tunnel) {
+	ts.mu.Lock()
+	delete(ts.active, t.id)
+	ts.mu.Unlock()
+	if ts.OnClose != nil {
+		ts.OnClose(t.stats())
+	}
+}
+
+// tunnelWriter writes the traffic to one side of a websocket tunnel,
+// keeping track of the frame boundaries in order to safely inject a close frame.
+type tunnelWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	masked  bool
+	frames  frameObserver
+	pending []byte
+	closed  bool
+}
+
+// Write writes the given data. Once a close frame has been sent,
+// the remaining data is discarded, as defined by RFC 6455.
+func (tw *tunnelWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		if tw.closed {
+			return written + len(p), nil
+		}
+		n := len(p)
+		if tw.pending != nil {
+			n = tw.frames.feed(p)
+		} else {
+			tw.frames.feedAll(p)
+		}
+		if _, err := tw.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		if tw.pending != nil && tw.frames.boundary() {
+			tw.flushClose()
+		}
+	}
+	return written, nil
+}
+
+// sendClose sends a close frame with the given payload
+// as soon as the current frame has been written.
+func (tw *tunnelWriter) sendClose(payload []byte) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.closed || tw.pending != nil {
+		return
+	}
+	buf := &bytes.Buffer{}
+	writeFrame(buf, true, opClose, payload, tw.masked)
+	tw.pending = buf.Bytes()
+	if tw.frames.boundary() {
+		tw.flushClose()
+	}
+}
+
+// flushClose writes the pending close frame.
+func (tw *tunnelWriter) flushClose() {
+	tw.w.Write(tw.pending)
+	tw.pending = nil
+	tw.closed = true
+}
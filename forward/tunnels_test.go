@@ -0,0 +1,153 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+	"golang.org/x/net/websocket"
+)
+
+func TestFrameObserver(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeFrame(buf, true, opText, bytes.Repeat([]byte("a"), 300), true)
+	writeFrame(buf, true, opClose, []byte{0x03, 0xE8, 'b', 'y', 'e'}, true)
+	writeFrame(buf, true, opClose, nil, false)
+
+	var codes []int
+	o := &frameObserver{onClose: func(code int) { codes = append(codes, code) }}
+	for _, b := range buf.Bytes() {
+		st.Expect(t, o.feed([]byte{b}), 1)
+	}
+	st.Expect(t, o.boundary(), true)
+	st.Expect(t, codes, []int{CloseNormal, CloseNoStatus})
+}
+
+func TestTunnelWriterClose(t *testing.T) {
+	frame := &bytes.Buffer{}
+	writeFrame(frame, true, opText, []byte("hello"), false)
+	data := frame.Bytes()
+
+	buf := &bytes.Buffer{}
+	tw := &tunnelWriter{w: buf}
+	tw.Write(data[:3])
+	tw.sendClose([]byte{0x03, 0xE9})
+	st.Expect(t, buf.Len(), 3)
+
+	n, err := tw.Write(append(data[3:], data...))
+	st.Expect(t, err, nil)
+	st.Expect(t, n, len(data)*2-3)
+
+	r := bufio.NewReader(buf)
+	fr, err := readFrame(r, DefaultMaxMessageSize)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(fr.payload), "hello")
+	fr, err = readFrame(r, DefaultMaxMessageSize)
+	st.Expect(t, err, nil)
+	st.Expect(t, fr.opcode, opClose)
+	_, err = readFrame(r, DefaultMaxMessageSize)
+	st.Expect(t, err, io.EOF)
+}
+
+func TestTunnelsDrain(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		msg := make([]byte, 512)
+		for {
+			n, err := conn.Read(msg)
+			if err != nil {
+				return
+			}
+			conn.Write(msg[:n])
+		}
+	}))
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	closed := make(chan TunnelStats, 1)
+	tunnels := NewTunnels()
+	tunnels.OnClose = func(stats TunnelStats) { closed <- stats }
+	proxy := newTestProxy(t, srv.URL, WebsocketTunnels(tunnels))
+	defer proxy.Close()
+
+	conn, err := websocket.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", "", "http://localhost")
+	st.Expect(t, err, nil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	st.Expect(t, err, nil)
+	msg := make([]byte, 5)
+	_, err = io.ReadFull(conn, msg)
+	st.Expect(t, err, nil)
+
+	active := tunnels.Active()
+	st.Expect(t, len(active), 1)
+	st.Expect(t, active[0].URL, srv.URL+"/ws")
+	st.Expect(t, tunnels.Close(active[0].ID+1, CloseNormal), ErrTunnelNotFound)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	st.Expect(t, tunnels.Drain(ctx), nil)
+	st.Expect(t, tunnels.Len(), 0)
+
+	// the client receives the close frame
+	_, err = conn.Read(msg)
+	st.Expect(t, err, io.EOF)
+
+	stats := <-closed
+	st.Expect(t, stats.ID, active[0].ID)
+	st.Expect(t, stats.CloseCode, CloseGoingAway)
+	st.Expect(t, stats.BytesIn > 5, true)
+	st.Expect(t, stats.BytesOut > 5, true)
+
+	// the drain is over: new tunnels are accepted again
+	conn, err = websocket.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", "", "http://localhost")
+	st.Expect(t, err, nil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("again"))
+	st.Expect(t, err, nil)
+	_, err = io.ReadFull(conn, msg)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(msg), "again")
+	st.Expect(t, tunnels.Len(), 1)
+}
+
+func TestTunnelsContext(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	tunnels := NewTunnels()
+	handler := newProxyHandler(t, srv.URL)
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		handler(w, req.WithContext(WithTunnels(req.Context(), tunnels)))
+	})
+	defer proxy.Close()
+
+	conn, err := websocket.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", "", "http://localhost")
+	st.Expect(t, err, nil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	st.Expect(t, err, nil)
+	msg := make([]byte, 5)
+	_, err = io.ReadFull(conn, msg)
+	st.Expect(t, err, nil)
+
+	st.Expect(t, tunnels.Len(), 1)
+	st.Expect(t, DefaultTunnels.Len(), 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	st.Expect(t, tunnels.Drain(ctx), nil)
+	_, err = conn.Read(msg)
+	st.Expect(t, err, io.EOF)
+}
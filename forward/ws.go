@@ -1,89 +1,507 @@
 package forward
 
 import (
+	"bufio"
+	"crypto/sha1"
 	"crypto/tls"
-	"gopkg.in/vinxi/utils.v0"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/vinxi/utils.v0"
 )
 
 // websocketForwarder is a handler that can reverse proxy
 // websocket traffic
 type websocketForwarder struct {
 	rewriter        ReqRewriter
+	balancer        *Balancer
+	dialer          *net.Dialer
+	idleTimeout     time.Duration
+	maxDuration     time.Duration
+	hooks           []MessageHook
+	maxMessageSize  int64
+	tunnels         *Tunnels
+	tls             *tlsConfigs
+	paths           []pathRewrite
+	handshake       time.Duration
+	queries         []*QueryRewriter
 	TLSClientConfig *tls.Config
 }
 
+// DefaultWebsocketHandshakeTimeout stores the default maximum duration of the
+// upstream TLS and websocket handshakes.
+var DefaultWebsocketHandshakeTimeout = 10 * time.Second
+
+// defaultDialer stores the dialer used by default to connect to websocket upstream servers.
+var defaultDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
 // serveHTTP forwards websocket traffic
 func (f *websocketForwarder) serveHTTP(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
 	outReq := f.copyRequest(req)
+	if f.balancer != nil {
+		u, err := f.balancer.Next(req)
+		if err != nil {
+			err = newError(PhaseDial, req.URL.Host, err)
+			ctx.log.Errorf("Error balancing websocket request: %v", err)
+			ctx.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		// the upstream server is in use for the whole tunnel lifetime
+		u.acquire()
+		defer u.release()
+		outReq.URL.Host = u.URL.Host
+		outReq.URL.Scheme = websocketScheme(u.URL.Scheme)
+	}
 	host := outReq.URL.Host
-	dial := net.Dial
+	secure := websocketScheme(outReq.URL.Scheme) == "wss"
 
 	// if host does not specify a port, use the default http port
 	if !strings.Contains(host, ":") {
-		if outReq.URL.Scheme == "wss" {
+		if secure {
 			host = host + ":443"
 		} else {
 			host = host + ":80"
 		}
 	}
 
-	if outReq.URL.Scheme == "wss" {
-		if f.TLSClientConfig == nil {
-			f.TLSClientConfig = &tls.Config{}
+	dialer := f.dialer
+	if dialer == nil {
+		dialer = defaultDialer
+	}
+	targetConn, err := dialer.DialContext(req.Context(), "tcp", host)
+	if err != nil {
+		err = newError(PhaseDial, host, err)
+		ctx.log.Errorf("Error dialing `%v`: %v", host, err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	// the dialer timeout only covers the connection, so the handshakes are limited as well
+	targetConn.SetDeadline(time.Now().Add(f.handshake))
+
+	if secure {
+		config := &tls.Config{}
+		if f.tls != nil {
+			config = f.tls.config(outReq.URL.Host)
+		} else if f.TLSClientConfig != nil {
+			config = f.TLSClientConfig.Clone()
 		}
-		dial = func(network, address string) (net.Conn, error) {
-			return tls.Dial("tcp", host, f.TLSClientConfig)
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(host)
 		}
+		tlsConn := tls.Client(targetConn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			targetConn.Close()
+			err = newError(PhaseTLSHandshake, host, err)
+			ctx.log.Errorf("Error in TLS handshake with `%v`: %v", host, err)
+			ctx.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		targetConn = tlsConn
 	}
 
-	targetConn, err := dial("tcp", host)
+	defer targetConn.Close()
+
+	// write the modified incoming request to the dialed connection
+	if err = outReq.Write(targetConn); err != nil {
+		err = newError(PhaseWriteRequest, host, err)
+		ctx.log.Errorf("Unable to copy request to target: %v", err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	// read the upstream handshake response before taking over the client connection
+	targetReader := bufio.NewReader(targetConn)
+	res, err := http.ReadResponse(targetReader, outReq)
 	if err != nil {
-		ctx.log.Errorf("Error dialing `%v`: %v", host, err)
+		err = newError(PhaseReadHeaders, host, err)
+		ctx.log.Errorf("Unable to read the upstream handshake response: %v", err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	// relay non-upgrade responses, such as authentication errors, as regular HTTP responses
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		defer res.Body.Close()
+		ctx.log.Infof("Websocket upgrade to %v rejected, code: %v", req.URL, res.StatusCode)
+		RemoveHopHeaders(res.Header, false)
+		utils.CopyHeaders(w.Header(), res.Header)
+		w.WriteHeader(res.StatusCode)
+		if _, err := io.Copy(w, res.Body); err != nil {
+			ctx.log.Errorf("Error copying upstream response Body: %v", err)
+		}
+		return
+	}
+
+	if err = validateHandshake(outReq, res); err != nil {
+		err = newError(PhaseReadHeaders, host, err)
+		ctx.log.Errorf("Invalid upstream websocket handshake: %v", err)
 		ctx.errHandler.ServeHTTP(w, req, err)
 		return
 	}
+
+	// the upgrade headers are the only hop-by-hop headers relayed to the client
+	RemoveHopHeaders(res.Header, true)
+
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
+		err = newError(PhaseHijack, host, errors.New("response writer does not support hijacking"))
 		ctx.log.Errorf("Unable to hijack the connection: %v", err)
 		ctx.errHandler.ServeHTTP(w, req, err)
 		return
 	}
-	underlyingConn, _, err := hijacker.Hijack()
+	underlyingConn, clientRW, err := hijacker.Hijack()
 	if err != nil {
+		err = newError(PhaseHijack, host, err)
 		ctx.log.Errorf("Unable to hijack the connection: %v", err)
 		ctx.errHandler.ServeHTTP(w, req, err)
 		return
 	}
 	// it is now caller's responsibility to Close the underlying connection
 	defer underlyingConn.Close()
-	defer targetConn.Close()
 
-	// write the modified incoming request to the dialed connection
-	if err = outReq.Write(targetConn); err != nil {
-		ctx.log.Errorf("Unable to copy request to target: %v", err)
-		ctx.errHandler.ServeHTTP(w, req, err)
+	// from now on errors can only be logged, since the client connection is hijacked
+	if err = writeHandshake(underlyingConn, res); err != nil {
+		ctx.log.Errorf("Unable to write the handshake response to the client: %v", err)
 		return
 	}
-	errc := make(chan error, 2)
-	replicate := func(dst io.Writer, src io.Reader) {
-		_, err := io.Copy(dst, src)
-		errc <- err
+
+	// the tunnel timeouts replace the handshake and server deadlines
+	targetConn.SetDeadline(time.Time{})
+	underlyingConn.SetDeadline(time.Time{})
+
+	// buffered readers may already contain data sent right after the handshake
+	t := newTunnel(underlyingConn, clientRW.Reader, targetConn, targetReader)
+	t.url = req.URL.String()
+	t.upstream = host
+	t.remoteAddr = req.RemoteAddr
+	t.idleTimeout = f.idleTimeout
+	t.maxDuration = f.maxDuration
+	if len(f.hooks) > 0 {
+		t.copiers = [2]*messageCopier{
+			{req: req, hooks: f.hooks, direction: ClientToUpstream, maxSize: f.maxMessageSize},
+			{req: req, hooks: f.hooks, direction: UpstreamToClient, maxSize: f.maxMessageSize},
+		}
 	}
-	go replicate(targetConn, underlyingConn)
-	go replicate(underlyingConn, targetConn)
-	<-errc
+
+	tunnels := f.tunnelsFor(req)
+	tunnels.add(t)
+	defer tunnels.remove(t)
+	err = t.splice()
+
+	stats := t.stats()
+	ctx.log.Infof("Websocket tunnel %d to %v closed after %v, in: %d bytes, out: %d bytes, close code: %d, err: %v",
+		stats.ID, req.URL, stats.Duration, stats.BytesIn, stats.BytesOut, stats.CloseCode, err)
 }
 
 // copyRequest makes a copy of the specified request.
+// The configured rewriter is applied keeping the protocol upgrade headers.
 func (f *websocketForwarder) copyRequest(req *http.Request) (outReq *http.Request) {
 	outReq = new(http.Request)
 	*outReq = *req
 	outReq.URL = utils.CopyURL(req.URL)
 	outReq.URL.Scheme = req.URL.Scheme
 	outReq.URL.Host = req.URL.Host
+	if len(f.paths) > 0 {
+		rewritePath(outReq.URL, f.paths)
+	}
+	// router captures are stripped even without query rewriters
+	rewriteQuery(outReq.URL, f.queries)
+
+	outReq.Header = make(http.Header)
+	utils.CopyHeaders(outReq.Header, req.Header)
+
+	if f.rewriter != nil {
+		upgrade := req.Header.Get(Upgrade)
+		f.rewriter.Rewrite(outReq)
+		outReq.Header.Set(Connection, "Upgrade")
+		outReq.Header.Set(Upgrade, upgrade)
+	}
+	// extensions such as permessage-deflate alter the frame payloads,
+	// preventing message hooks from inspecting them
+	if len(f.hooks) > 0 {
+		outReq.Header.Del(SecWebsocketExtensions)
+	}
 	return outReq
 }
+
+// websocketScheme returns the websocket scheme for the given upstream URL scheme.
+func websocketScheme(scheme string) string {
+	if scheme == "https" || scheme == "wss" {
+		return "wss"
+	}
+	return "ws"
+}
+
+// websocketGUID is the globally unique identifier defined by RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketAccept returns the expected Sec-WebSocket-Accept value for the given key.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// validateHandshake verifies the upstream handshake response
+// against the websocket upgrade request.
+func validateHandshake(req *http.Request, res *http.Response) error {
+	if !headerContainsToken(res.Header, Upgrade, "websocket") {
+		return errors.New("missing websocket upgrade header")
+	}
+	if !headerContainsToken(res.Header, Connection, "upgrade") {
+		return errors.New("missing connection upgrade header")
+	}
+	if key := req.Header.Get(SecWebsocketKey); key != "" && res.Header.Get(SecWebsocketAccept) != websocketAccept(key) {
+		return errors.New("invalid Sec-WebSocket-Accept header")
+	}
+	if protocol := res.Header.Get(SecWebsocketProtocol); protocol != "" && !headerContainsToken(req.Header, SecWebsocketProtocol, protocol) {
+		return fmt.Errorf("unrequested subprotocol: %s", protocol)
+	}
+	for _, ext := range headerTokens(res.Header, SecWebsocketExtensions) {
+		name := strings.TrimSpace(strings.Split(ext, ";")[0])
+		if !requestedExtension(req.Header, name) {
+			return fmt.Errorf("unrequested extension: %s", name)
+		}
+	}
+	return nil
+}
+
+// requestedExtension returns true if the given extension was offered by the client.
+func requestedExtension(h http.Header, name string) bool {
+	for _, ext := range headerTokens(h, SecWebsocketExtensions) {
+		if strings.EqualFold(strings.TrimSpace(strings.Split(ext, ";")[0]), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHandshake writes the upstream handshake response to the client connection.
+func writeHandshake(w io.Writer, res *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", res.Status); err != nil {
+		return err
+	}
+	if err := res.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// tunnelID stores the last assigned tunnel ID.
+var tunnelID uint64
+
+// tunnel splices a hijacked client connection with an upstream connection.
+// If message copiers are defined, the traffic is parsed as websocket frames,
+// otherwise the raw bytes are copied as they are.
+type tunnel struct {
+	// bytesIn and bytesOut are accessed atomically
+	bytesIn  int64
+	bytesOut int64
+
+	id          uint64
+	url         string
+	upstream    string
+	remoteAddr  string
+	start       time.Time
+	client      net.Conn
+	clientR     io.Reader
+	target      net.Conn
+	targetR     io.Reader
+	toClient    *tunnelWriter
+	toUpstream  *tunnelWriter
+	idleTimeout time.Duration
+	maxDuration time.Duration
+	copiers     [2]*messageCopier
+
+	mu        sync.Mutex
+	activity  time.Time
+	end       time.Time
+	closeCode int
+	closeErr  error
+	err       error
+	done      bool
+}
+
+// newTunnel creates a new tunnel between the given client and upstream connections.
+func newTunnel(client net.Conn, clientR io.Reader, target net.Conn, targetR io.Reader) *tunnel {
+	t := &tunnel{
+		id:      atomic.AddUint64(&tunnelID, 1),
+		start:   time.Now(),
+		client:  client,
+		clientR: clientR,
+		target:  target,
+		targetR: targetR,
+	}
+	// frames sent to the upstream server must be masked
+	t.toClient = &tunnelWriter{w: client}
+	t.toUpstream = &tunnelWriter{w: target, masked: true}
+	t.toClient.frames.onClose = t.setCloseCode
+	t.toUpstream.frames.onClose = t.setCloseCode
+	return t
+}
+
+// errTunnelIdle is returned when the tunnel is closed due to inactivity.
+var errTunnelIdle = errors.New("websocket tunnel idle timeout exceeded")
+
+// errTunnelExpired is returned when the tunnel is closed after its maximum duration.
+var errTunnelExpired = errors.New("websocket tunnel max duration exceeded")
+
+// splice copies the data in both directions until one side is closed
+// or the tunnel timeouts are exceeded.
+func (t *tunnel) splice() error {
+	t.touch()
+	if t.idleTimeout > 0 {
+		timer := time.AfterFunc(t.idleTimeout, t.checkIdle)
+		defer timer.Stop()
+	}
+	if t.maxDuration > 0 {
+		timer := time.AfterFunc(t.maxDuration, func() { t.close(errTunnelExpired) })
+		defer timer.Stop()
+	}
+
+	errc := make(chan error, 2)
+	replicate := func(dst io.Writer, src io.Reader, counter *int64, c *messageCopier) {
+		src = &activityReader{src, t, counter}
+		if c != nil {
+			errc <- c.copy(dst, src)
+			return
+		}
+		_, err := io.Copy(dst, src)
+		errc <- err
+	}
+	go replicate(t.toUpstream, t.clientR, &t.bytesIn, t.copiers[ClientToUpstream])
+	go replicate(t.toClient, t.targetR, &t.bytesOut, t.copiers[UpstreamToClient])
+	err := <-errc
+
+	// unblock the other direction and wait for it, so the metrics are final
+	t.client.Close()
+	t.target.Close()
+	<-errc
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done = true
+	t.end = time.Now()
+	if t.closeErr != nil {
+		err = t.closeErr
+	}
+	t.err = err
+	return err
+}
+
+// shutdown gracefully closes the tunnel, sending a close frame
+// with the given status code to both sides.
+func (t *tunnel) shutdown(code int) {
+	t.setCloseCode(code)
+	payload := []byte{byte(code >> 8), byte(code)}
+	t.toClient.sendClose(payload)
+	t.toUpstream.sendClose(payload)
+}
+
+// setCloseCode records the status code of the first close frame.
+func (t *tunnel) setCloseCode(code int) {
+	t.mu.Lock()
+	if t.closeCode == 0 {
+		t.closeCode = code
+	}
+	t.mu.Unlock()
+}
+
+// stats returns the tunnel metrics.
+func (t *tunnel) stats() TunnelStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := TunnelStats{
+		ID:         t.id,
+		URL:        t.url,
+		Upstream:   t.upstream,
+		RemoteAddr: t.remoteAddr,
+		Start:      t.start,
+		Duration:   time.Since(t.start),
+		BytesIn:    atomic.LoadInt64(&t.bytesIn),
+		BytesOut:   atomic.LoadInt64(&t.bytesOut),
+		CloseCode:  t.closeCode,
+	}
+	if t.done {
+		stats.Duration = t.end.Sub(t.start)
+	}
+	if t.err != nil {
+		stats.Error = t.err.Error()
+	}
+	return stats
+}
+
+// checkIdle closes the tunnel if there was no activity during the idle timeout,
+// otherwise it schedules the next check.
+func (t *tunnel) checkIdle() {
+	t.mu.Lock()
+	idle, done := time.Since(t.activity), t.done
+	t.mu.Unlock()
+	if done {
+		return
+	}
+	if idle >= t.idleTimeout {
+		t.close(errTunnelIdle)
+		return
+	}
+	time.AfterFunc(t.idleTimeout-idle, t.checkIdle)
+}
+
+// touch records activity in the tunnel.
+func (t *tunnel) touch() {
+	t.mu.Lock()
+	t.activity = time.Now()
+	t.mu.Unlock()
+}
+
+// close closes both sides of the tunnel with the given reason.
+func (t *tunnel) close(reason error) {
+	t.mu.Lock()
+	if t.closeErr == nil {
+		t.closeErr = reason
+	}
+	t.mu.Unlock()
+	t.client.Close()
+	t.target.Close()
+}
+
+// activityReader records tunnel activity and counts the bytes on every read.
+type activityReader struct {
+	io.Reader
+	t       *tunnel
+	counter *int64
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.t.touch()
+		atomic.AddInt64(r.counter, int64(n))
+	}
+	return n, err
+}
+
+// tunnelsFor returns the registry keeping track of the tunnel of the given request:
+// the forwarder registry, the request context one or DefaultTunnels, in that order.
+func (f *websocketForwarder) tunnelsFor(req *http.Request) *Tunnels {
+	if f.tunnels != nil {
+		return f.tunnels
+	}
+	if ts, ok := req.Context().Value(tunnelsContextKey{}).(*Tunnels); ok && ts != nil {
+		return ts
+	}
+	return DefaultTunnels
+}
@@ -1 +1,233 @@
 package forward
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+	"golang.org/x/net/websocket"
+)
+
+// sendUpgradeRequest sends a raw websocket upgrade request and returns the handshake response.
+func sendUpgradeRequest(t *testing.T, addr string, header http.Header) *http.Response {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	st.Expect(t, err, nil)
+
+	req, _ := http.NewRequest("GET", "http://"+addr+"/ws", nil)
+	req.Header.Set(Connection, "Upgrade")
+	req.Header.Set(Upgrade, "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set(SecWebsocketKey, "dGhlIHNhbXBsZSBub25jZQ==")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	st.Expect(t, req.Write(conn), nil)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	st.Expect(t, err, nil)
+	return res
+}
+
+func TestWebsocketAccept(t *testing.T) {
+	// Sample handshake from RFC 6455
+	st.Expect(t, websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+}
+
+func TestWebsocketRejectedHandshake(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL)
+	defer proxy.Close()
+
+	res := sendUpgradeRequest(t, proxy.Listener.Addr().String(), nil)
+	body, _ := ioutil.ReadAll(res.Body)
+	st.Expect(t, res.StatusCode, http.StatusUnauthorized)
+	st.Expect(t, res.Header.Get("WWW-Authenticate"), "Bearer")
+	st.Expect(t, string(body), "unauthorized")
+}
+
+func TestWebsocketInvalidHandshake(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		conn, brw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		brw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+		brw.WriteString("Sec-WebSocket-Accept: invalid\r\n\r\n")
+		brw.Flush()
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL)
+	defer proxy.Close()
+
+	res := sendUpgradeRequest(t, proxy.Listener.Addr().String(), nil)
+	st.Expect(t, res.StatusCode, http.StatusBadGateway)
+}
+
+func TestWebsocketUnrequestedSubprotocol(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		conn, brw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		brw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+		brw.WriteString("Sec-WebSocket-Accept: " + websocketAccept(req.Header.Get(SecWebsocketKey)) + "\r\n")
+		brw.WriteString("Sec-WebSocket-Protocol: mqtt\r\n\r\n")
+		brw.Flush()
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL)
+	defer proxy.Close()
+
+	res := sendUpgradeRequest(t, proxy.Listener.Addr().String(), http.Header{SecWebsocketProtocol: {"chat, superchat"}})
+	st.Expect(t, res.StatusCode, http.StatusBadGateway)
+}
+
+func TestWebsocketRewriter(t *testing.T) {
+	var outHeaders http.Header
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		outHeaders = conn.Request().Header
+		conn.Write([]byte("ok"))
+		conn.Close()
+	}))
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL)
+	defer proxy.Close()
+
+	conn, err := websocket.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", "", "http://localhost")
+	st.Expect(t, err, nil)
+	msg := make([]byte, 2)
+	_, err = conn.Read(msg)
+	conn.Close()
+	st.Expect(t, err, nil)
+	st.Expect(t, string(msg), "ok")
+	st.Expect(t, outHeaders.Get(XForwardedFor), "127.0.0.1")
+	st.Expect(t, outHeaders.Get(XForwardedProto), "http")
+	st.Expect(t, outHeaders.Get(Upgrade), "websocket")
+}
+
+func TestWebsocketIdleTimeout(t *testing.T) {
+	closed := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		msg := make([]byte, 512)
+		for {
+			n, err := conn.Read(msg)
+			if err != nil {
+				close(closed)
+				return
+			}
+			conn.Write(msg[:n])
+		}
+	}))
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	f, err := New(WebsocketTimeouts(50*time.Millisecond, 0))
+	st.Expect(t, err, nil)
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	conn, err := websocket.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", "", "http://localhost")
+	st.Expect(t, err, nil)
+	defer conn.Close()
+
+	// Activity keeps the tunnel open
+	for i := 0; i < 3; i++ {
+		time.Sleep(30 * time.Millisecond)
+		_, err = conn.Write([]byte("ping"))
+		st.Expect(t, err, nil)
+		msg := make([]byte, 4)
+		_, err = conn.Read(msg)
+		st.Expect(t, err, nil)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("idle websocket tunnel was not closed")
+	}
+}
+
+func TestWebsocketHandshakeTimeout(t *testing.T) {
+	// the upstream server accepts the connection, but never replies
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	st.Expect(t, err, nil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	proxy := newTestProxy(t, "http://"+ln.Addr().String(), WebsocketHandshakeTimeout(50*time.Millisecond))
+	defer proxy.Close()
+
+	res := sendUpgradeRequest(t, proxy.Listener.Addr().String(), nil)
+	st.Expect(t, res.StatusCode, http.StatusGatewayTimeout)
+}
+
+func TestWebsocketServerTimeouts(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		msg := make([]byte, 4)
+		for {
+			n, err := conn.Read(msg)
+			if err != nil {
+				return
+			}
+			conn.Write(msg[:n])
+		}
+	}))
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	f, err := New()
+	st.Expect(t, err, nil)
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	}))
+	proxy.Config.ReadTimeout = 50 * time.Millisecond
+	proxy.Config.WriteTimeout = 50 * time.Millisecond
+	proxy.Start()
+	defer proxy.Close()
+
+	conn, err := websocket.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", "", "http://localhost")
+	st.Expect(t, err, nil)
+	defer conn.Close()
+
+	// the hijacked connection outlives the server timeouts
+	time.Sleep(100 * time.Millisecond)
+	_, err = conn.Write([]byte("ping"))
+	st.Expect(t, err, nil)
+	msg := make([]byte, 4)
+	_, err = conn.Read(msg)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(msg), "ping")
+}
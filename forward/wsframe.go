@@ -0,0 +1,400 @@
+package forward
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Direction represents the direction of a websocket message.
+type Direction int
+
+const (
+	// ClientToUpstream identifies messages sent by the client.
+	ClientToUpstream Direction = iota
+	// UpstreamToClient identifies messages sent by the upstream server.
+	UpstreamToClient
+)
+
+// String returns the direction name.
+func (d Direction) String() string {
+	if d == ClientToUpstream {
+		return "client-to-upstream"
+	}
+	return "upstream-to-client"
+}
+
+// MessageType represents a websocket data message type, as defined by RFC 6455.
+type MessageType byte
+
+const (
+	// TextMessage identifies UTF-8 encoded text messages.
+	TextMessage MessageType = 1
+	// BinaryMessage identifies binary data messages.
+	BinaryMessage MessageType = 2
+)
+
+// Websocket frame opcodes, as defined by RFC 6455.
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+// Websocket close status codes, as defined by RFC 6455.
+const (
+	// CloseNormal indicates a normal closure.
+	CloseNormal = 1000
+	// CloseGoingAway indicates that an endpoint is going away, such as a server shutting down.
+	CloseGoingAway = 1001
+	// CloseNoStatus indicates that a close frame was received without status code.
+	CloseNoStatus = 1005
+)
+
+// DefaultMaxMessageSize stores the default maximum websocket message size
+// accepted when inspecting websocket messages.
+var DefaultMaxMessageSize int64 = 16 << 20
+
+// errMessageTooLarge is returned when a websocket message exceeds the maximum size.
+var errMessageTooLarge = errors.New("websocket message too large")
+
+// Message represents a complete, defragmented websocket data message.
+type Message struct {
+	// Direction stores the message direction.
+	Direction Direction
+	// Type stores the message type.
+	Type MessageType
+	// Data stores the unmasked message payload.
+	Data []byte
+}
+
+// MessageHook can observe, transform or drop websocket messages.
+type MessageHook interface {
+	// HandleMessage is called with every data message flowing through the tunnel.
+	// It returns the message to forward, or nil to drop it.
+	// Returning an error closes the websocket tunnel.
+	HandleMessage(req *http.Request, msg *Message) (*Message, error)
+}
+
+// MessageHookFunc is an adapter to use ordinary functions as MessageHook.
+type MessageHookFunc func(req *http.Request, msg *Message) (*Message, error)
+
+// HandleMessage calls f(req, msg).
+func (f MessageHookFunc) HandleMessage(req *http.Request, msg *Message) (*Message, error) {
+	return f(req, msg)
+}
+
+// wsFrame represents a websocket frame.
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// isControl returns true if the frame is a control frame.
+func (fr *wsFrame) isControl() bool {
+	return fr.opcode&0x8 != 0
+}
+
+// readFrame reads and unmasks a websocket frame.
+func readFrame(r *bufio.Reader, maxSize int64) (*wsFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	fr := &wsFrame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0F}
+	if header[0]&0x70 != 0 {
+		return nil, errors.New("websocket frame uses unsupported extensions")
+	}
+
+	size := int64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		size = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		size = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	if fr.isControl() && (size > 125 || !fr.fin) {
+		return nil, fmt.Errorf("invalid websocket control frame: opcode %d", fr.opcode)
+	}
+	if size < 0 || size > maxSize {
+		return nil, errMessageTooLarge
+	}
+
+	var mask [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	fr.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, fr.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(mask, fr.payload)
+	}
+	return fr, nil
+}
+
+// writeFrame writes a websocket frame, masking the payload if required.
+// Frames sent by clients must be masked, as defined by RFC 6455.
+func writeFrame(w io.Writer, fin bool, opcode byte, payload []byte, masked bool) error {
+	header := make([]byte, 2, 14)
+	header[0] = opcode
+	if fin {
+		header[0] |= 0x80
+	}
+
+	size := len(payload)
+	switch {
+	case size <= 125:
+		header[1] = byte(size)
+	case size <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(size))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(size))
+	}
+
+	if masked {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		header[1] |= 0x80
+		header = append(header, mask[:]...)
+		data := make([]byte, size)
+		copy(data, payload)
+		maskBytes(mask, data)
+		payload = data
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// maskBytes applies the websocket masking algorithm to the given data.
+func maskBytes(mask [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+}
+
+// messageCopier copies websocket messages in one direction, passing
+// every complete data message through the message hooks.
+type messageCopier struct {
+	req       *http.Request
+	hooks     []MessageHook
+	direction Direction
+	maxSize   int64
+}
+
+// copy reads frames from src and writes them to dst until an error occurs.
+// Control frames are forwarded as they are, while fragmented data messages
+// are forwarded as a single frame once complete.
+func (c *messageCopier) copy(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+	masked := c.direction == ClientToUpstream
+
+	var msg *Message
+	for {
+		fr, err := readFrame(r, c.maxSize)
+		if err != nil {
+			return err
+		}
+
+		if fr.isControl() {
+			if err := writeFrame(dst, true, fr.opcode, fr.payload, masked); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case fr.opcode == opContinuation && msg == nil:
+			return errors.New("unexpected websocket continuation frame")
+		case fr.opcode != opContinuation && msg != nil:
+			return errors.New("unexpected websocket data frame in fragmented message")
+		case fr.opcode == opText || fr.opcode == opBinary:
+			msg = &Message{Direction: c.direction, Type: MessageType(fr.opcode)}
+		case fr.opcode != opContinuation:
+			return fmt.Errorf("unsupported websocket opcode: %d", fr.opcode)
+		}
+
+		if int64(len(msg.Data)+len(fr.payload)) > c.maxSize {
+			return errMessageTooLarge
+		}
+		msg.Data = append(msg.Data, fr.payload...)
+		if !fr.fin {
+			continue
+		}
+
+		out, err := c.handle(msg)
+		msg = nil
+		if err != nil {
+			return err
+		}
+		if out == nil {
+			continue
+		}
+		if err := writeFrame(dst, true, byte(out.Type), out.Data, masked); err != nil {
+			return err
+		}
+	}
+}
+
+// handle passes the given message through the message hooks.
+func (c *messageCopier) handle(msg *Message) (*Message, error) {
+	var err error
+	for _, hook := range c.hooks {
+		if msg, err = hook.HandleMessage(c.req, msg); err != nil || msg == nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// frameObserver incrementally parses a websocket byte stream, tracking
+// the frame boundaries and the close frames without altering the data.
+type frameObserver struct {
+	header    [14]byte
+	headerLen int
+	opcode    byte
+	masked    bool
+	mask      [4]byte
+	remaining int64
+	offset    int64
+	code      [2]byte
+	// onClose is called with the status code of every observed close frame.
+	onClose func(code int)
+}
+
+// boundary returns true if the observed stream is not in the middle of a frame.
+func (o *frameObserver) boundary() bool {
+	return o.headerLen == 0 && o.remaining == 0
+}
+
+// feedAll observes all the given bytes.
+func (o *frameObserver) feedAll(p []byte) {
+	for len(p) > 0 {
+		p = p[o.feed(p):]
+	}
+}
+
+// feed observes the given bytes up to the end of the current frame,
+// returning the number of bytes consumed.
+func (o *frameObserver) feed(p []byte) int {
+	n := 0
+	for n < len(p) {
+		if o.remaining == 0 {
+			o.header[o.headerLen] = p[n]
+			o.headerLen++
+			n++
+			if o.headerLen < 2 || o.headerLen < o.headerSize() {
+				continue
+			}
+			o.parseHeader()
+			if o.remaining == 0 {
+				o.frameDone()
+				return n
+			}
+			continue
+		}
+
+		chunk := int64(len(p) - n)
+		if chunk > o.remaining {
+			chunk = o.remaining
+		}
+		for i := int64(0); i < chunk && o.offset+i < 2; i++ {
+			b := p[n+int(i)]
+			if o.masked {
+				b ^= o.mask[(o.offset+i)%4]
+			}
+			o.code[o.offset+i] = b
+		}
+		o.offset += chunk
+		o.remaining -= chunk
+		n += int(chunk)
+		if o.remaining == 0 {
+			o.frameDone()
+			return n
+		}
+	}
+	return n
+}
+
+// headerSize returns the size of the current frame header.
+func (o *frameObserver) headerSize() int {
+	size := 2
+	switch o.header[1] & 0x7F {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if o.header[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+// parseHeader parses the current frame header.
+func (o *frameObserver) parseHeader() {
+	o.opcode = o.header[0] & 0x0F
+	o.masked = o.header[1]&0x80 != 0
+	o.offset = 0
+
+	pos := 2
+	switch size := o.header[1] & 0x7F; size {
+	case 126:
+		o.remaining = int64(binary.BigEndian.Uint16(o.header[2:]))
+		pos += 2
+	case 127:
+		o.remaining = int64(binary.BigEndian.Uint64(o.header[2:]) & (1<<63 - 1))
+		pos += 8
+	default:
+		o.remaining = int64(size)
+	}
+	if o.masked {
+		copy(o.mask[:], o.header[pos:pos+4])
+	}
+	o.headerLen = 0
+}
+
+// frameDone is called once the current frame has been fully observed.
+func (o *frameObserver) frameDone() {
+	if o.opcode != opClose || o.onClose == nil {
+		return
+	}
+	code := CloseNoStatus
+	if o.offset >= 2 {
+		code = int(binary.BigEndian.Uint16(o.code[:]))
+	}
+	o.onClose(code)
+}
@@ -0,0 +1,168 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedMode defines the forwarding headers generated by HeaderRewriter.
+type ForwardedMode int
+
+const (
+	// ForwardedLegacy generates the X-Forwarded-* headers only.
+	ForwardedLegacy ForwardedMode = iota
+	// ForwardedStandard generates the RFC 7239 Forwarded header only.
+	ForwardedStandard
+	// ForwardedBoth generates both the X-Forwarded-* and Forwarded headers.
+	ForwardedBoth
+)
+
+// ForwardedElement represents a single proxy hop of the RFC 7239 Forwarded header.
+// Node identifiers are kept as sent, such as "192.0.2.1", "[2001:db8::1]:80",
+// "unknown" or obfuscated identifiers like "_proxy1".
+type ForwardedElement struct {
+	For   string
+	By    string
+	Proto string
+	Host  string
+}
+
+// String returns the element formatted as Forwarded header value,
+// quoting the values when required.
+func (e ForwardedElement) String() string {
+	var pairs []string
+	for _, pair := range [][2]string{{"for", e.For}, {"by", e.By}, {"proto", e.Proto}, {"host", e.Host}} {
+		if pair[1] != "" {
+			pairs = append(pairs, pair[0]+"="+quoteForwarded(pair[1]))
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// ParseForwarded parses the Forwarded headers of the given header map,
+// returning the elements in the order the proxies were traversed.
+// Unknown parameters are ignored.
+func ParseForwarded(h http.Header) []ForwardedElement {
+	var elements []ForwardedElement
+	for _, value := range h[Forwarded] {
+		for _, element := range splitQuoted(value, ',') {
+			var e ForwardedElement
+			for _, pair := range splitQuoted(element, ';') {
+				i := strings.Index(pair, "=")
+				if i < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:i]))
+				value := unquoteForwarded(strings.TrimSpace(pair[i+1:]))
+				switch key {
+				case "for":
+					e.For = value
+				case "by":
+					e.By = value
+				case "proto":
+					e.Proto = value
+				case "host":
+					e.Host = value
+				}
+			}
+			if e != (ForwardedElement{}) {
+				elements = append(elements, e)
+			}
+		}
+	}
+	return elements
+}
+
+// ForwardedNode returns the Forwarded node identifier of the given IP and optional port,
+// enclosing IPv6 addresses in brackets.
+func ForwardedNode(ip, port string) string {
+	if strings.Contains(ip, ":") {
+		ip = "[" + ip + "]"
+	}
+	if port != "" {
+		return ip + ":" + port
+	}
+	return ip
+}
+
+// setForwarded sets the Forwarded header of the given request, appending
+// a new element to the elements sent by trusted clients.
+func (rw *HeaderRewriter) setForwarded(req *http.Request, trusted bool) {
+	e := ForwardedElement{For: ForwardedNode(remoteIP(req.RemoteAddr), ""), By: rw.ForwardedBy, Host: clientHost(req), Proto: "http"}
+	if req.TLS != nil {
+		e.Proto = "https"
+	}
+	if e.By == "" {
+		if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+				e.By = ForwardedNode(host, port)
+			}
+		}
+	}
+
+	value := e.String()
+	if prior := req.Header[Forwarded]; trusted && len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	req.Header.Set(Forwarded, value)
+}
+
+// isForwardedToken returns true if the given value can be sent without quotes.
+func isForwardedToken(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, c := range value {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// quoteForwarded returns the given value as token or quoted string.
+func quoteForwarded(value string) string {
+	if isForwardedToken(value) {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// unquoteForwarded returns the given token or quoted string value unquoted.
+func unquoteForwarded(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	value = value[1 : len(value)-1]
+	unquoted := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		unquoted = append(unquoted, value[i])
+	}
+	return string(unquoted)
+}
+
+// splitQuoted splits the given value by the given separator,
+// ignoring the separators within quoted strings.
+func splitQuoted(value string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(value); i++ {
+		switch {
+		case quoted && value[i] == '\\':
+			i++
+		case value[i] == '"':
+			quoted = !quoted
+		case !quoted && value[i] == sep:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
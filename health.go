@@ -0,0 +1,249 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/vinxi/utils.v0"
+)
+
+// HealthCheck defines the upstream servers health checking options.
+type HealthCheck struct {
+	// Path defines the HTTP path used to actively probe the upstream servers.
+	// Active probes are disabled if no path is defined.
+	Path string
+	// Interval defines the interval between active probes. Defaults to 10 seconds.
+	Interval time.Duration
+	// Timeout defines the maximum duration of an active probe. Defaults to the probe interval.
+	Timeout time.Duration
+	// ExpectedStatus defines the status code expected from healthy upstream servers.
+	// Defaults to 200 OK.
+	ExpectedStatus int
+	// MaxFails defines the number of consecutive failures required to eject
+	// an upstream server. Defaults to 3.
+	MaxFails int
+	// Passive enables counting 5xx responses and connection errors
+	// of the forwarded traffic as upstream failures.
+	Passive bool
+	// EjectDuration defines how long an upstream server stays ejected before
+	// receiving traffic again, if active probes are disabled. Defaults to 30 seconds.
+	EjectDuration time.Duration
+	// Client defines the HTTP client used by active probes.
+	Client *http.Client
+	// Logger defines the logger used to report upstream state changes.
+	Logger utils.Logger
+}
+
+// UpstreamStatus represents the health state of an upstream server.
+type UpstreamStatus struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Fails     int       `json:"fails"`
+	Conns     int64     `json:"conns"`
+	LastError string    `json:"lastError,omitempty"`
+	LastCheck time.Time `json:"lastCheck"`
+}
+
+// upstreamHealth stores the health state of an upstream server.
+type upstreamHealth struct {
+	mu        sync.Mutex
+	ejected   bool
+	ejectedAt time.Time
+	fails     int
+	lastError error
+	lastCheck time.Time
+}
+
+// HealthChecker checks the health of the upstream servers of a balancer,
+// preventing the balancer from forwarding traffic to unhealthy servers.
+type HealthChecker struct {
+	options  HealthCheck
+	balancer *Balancer
+	log      utils.Logger
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewHealthChecker creates a new health checker for the given balancer.
+// Call Start to begin actively probing the upstream servers.
+func NewHealthChecker(b *Balancer, options HealthCheck) *HealthChecker {
+	if options.Interval == 0 {
+		options.Interval = 10 * time.Second
+	}
+	if options.Timeout == 0 {
+		options.Timeout = options.Interval
+	}
+	if options.ExpectedStatus == 0 {
+		options.ExpectedStatus = http.StatusOK
+	}
+	if options.MaxFails == 0 {
+		options.MaxFails = 3
+	}
+	if options.EjectDuration == 0 {
+		options.EjectDuration = 30 * time.Second
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Transport: utils.DefaultTransport}
+	}
+	if options.Logger == nil {
+		options.Logger = utils.NullLogger
+	}
+
+	hc := &HealthChecker{options: options, balancer: b, log: options.Logger, stop: make(chan struct{})}
+	b.setHealthChecker(hc)
+	return hc
+}
+
+// Start starts actively probing the upstream servers, if enabled.
+func (hc *HealthChecker) Start() {
+	if hc.options.Path == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(hc.options.Interval)
+		defer ticker.Stop()
+		for {
+			hc.Check()
+			select {
+			case <-ticker.C:
+			case <-hc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the active probes.
+func (hc *HealthChecker) Stop() {
+	hc.once.Do(func() { close(hc.stop) })
+}
+
+// Check probes all the upstream servers once.
+func (hc *HealthChecker) Check() {
+	var wg sync.WaitGroup
+	for _, u := range hc.balancer.Upstreams() {
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			hc.report(u, hc.probe(u), true)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// probe performs an active health probe against the given upstream server.
+func (hc *HealthChecker) probe(u *Upstream) error {
+	target := utils.CopyURL(u.URL)
+	target.Path = hc.options.Path
+	target.RawQuery = ""
+
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.options.Timeout)
+	defer cancel()
+
+	res, err := hc.options.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != hc.options.ExpectedStatus {
+		return fmt.Errorf("unexpected health check status: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// observe reports the outcome of a forwarded round trip as passive health check.
+func (hc *HealthChecker) observe(u *Upstream, res *http.Response, err error) {
+	if !hc.options.Passive {
+		return
+	}
+	if err == nil && res.StatusCode >= 500 {
+		err = fmt.Errorf("upstream replied with status: %d", res.StatusCode)
+	}
+	hc.report(u, err, false)
+}
+
+// report updates the upstream health state based on the given check result.
+// Only active probes can bring an ejected upstream server back.
+func (hc *HealthChecker) report(u *Upstream, err error, active bool) {
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if active {
+		h.lastCheck = time.Now()
+	}
+	if err == nil {
+		h.fails = 0
+		if h.ejected && active {
+			h.ejected = false
+			hc.log.Infof("Upstream %v recovered", u.URL)
+		}
+		return
+	}
+
+	h.fails++
+	h.lastError = err
+	if !h.ejected && h.fails >= hc.options.MaxFails {
+		h.ejected = true
+		h.ejectedAt = time.Now()
+		hc.log.Warningf("Upstream %v ejected after %d failures, err: %v", u.URL, h.fails, err)
+	}
+}
+
+// healthy returns true if the given upstream server can receive traffic.
+func (hc *HealthChecker) healthy(u *Upstream) bool {
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.ejected {
+		return true
+	}
+	// Without active probes, ejected upstream servers are given a new chance
+	// after the eject duration: a single failure ejects them again.
+	if hc.ejectExpired(h) {
+		h.ejected = false
+		h.fails = hc.options.MaxFails - 1
+		hc.log.Infof("Upstream %v back after %v", u.URL, hc.options.EjectDuration)
+		return true
+	}
+	return false
+}
+
+// ejectExpired returns true if the given ejected upstream server is given a new chance,
+// since its eject duration elapsed without active probes.
+// The upstream health state must be locked.
+func (hc *HealthChecker) ejectExpired(h *upstreamHealth) bool {
+	return hc.options.Path == "" && time.Since(h.ejectedAt) >= hc.options.EjectDuration
+}
+
+// status returns the health state of the given upstream server,
+// without changing it.
+func (hc *HealthChecker) status(u *Upstream) UpstreamStatus {
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := UpstreamStatus{
+		URL:       u.URL.String(),
+		Healthy:   !h.ejected || hc.ejectExpired(h),
+		Fails:     h.fails,
+		Conns:     u.Conns(),
+		LastCheck: h.lastCheck,
+	}
+	if h.lastError != nil {
+		status.LastError = h.lastError.Error()
+	}
+	return status
+}
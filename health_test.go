@@ -0,0 +1,143 @@
+package forward
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestHealthCheckActive(t *testing.T) {
+	var healthy int32 = 1
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" && atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	b, err := NewBalancer(nil, srv.URL)
+	st.Expect(t, err, nil)
+	hc := NewHealthChecker(b, HealthCheck{Path: "/health", MaxFails: 2})
+
+	hc.Check()
+	st.Expect(t, b.Health()[0].Healthy, true)
+
+	atomic.StoreInt32(&healthy, 0)
+	hc.Check()
+	st.Expect(t, b.Health()[0].Healthy, true)
+	hc.Check()
+	status := b.Health()[0]
+	st.Expect(t, status.Healthy, false)
+	st.Expect(t, status.Fails, 2)
+	st.Expect(t, status.LastError, "unexpected health check status: 503")
+
+	req, _ := http.NewRequest("GET", "http://foo", nil)
+	_, err = b.Next(req)
+	st.Expect(t, err, ErrNoUpstream)
+
+	// Ejected upstream servers come back once they recover
+	atomic.StoreInt32(&healthy, 1)
+	hc.Check()
+	st.Expect(t, b.Health()[0].Healthy, true)
+	_, err = b.Next(req)
+	st.Expect(t, err, nil)
+}
+
+func TestHealthCheckPassive(t *testing.T) {
+	var calls int32
+	bad := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer bad.Close()
+	good := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer good.Close()
+
+	b, err := NewBalancer(RoundRobin(), bad.URL, good.URL)
+	st.Expect(t, err, nil)
+	NewHealthChecker(b, HealthCheck{Passive: true, MaxFails: 2, EjectDuration: 50 * time.Millisecond})
+
+	proxy := testutils.NewHandler(ToMany(b))
+	defer proxy.Close()
+
+	for i := 0; i < 8; i++ {
+		testutils.Get(proxy.URL)
+	}
+	st.Expect(t, atomic.LoadInt32(&calls), int32(2))
+	st.Expect(t, b.Health()[0].Healthy, false)
+	st.Expect(t, b.Health()[1].Healthy, true)
+
+	// Ejected upstream servers receive traffic again after the eject duration,
+	// while querying their health state does not change it
+	time.Sleep(60 * time.Millisecond)
+	st.Expect(t, b.Health()[0].Healthy, true)
+	st.Expect(t, b.Health()[0].Fails, 2)
+}
+
+func TestHealthCheckPassiveTimeout(t *testing.T) {
+	hung := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	})
+	defer hung.Close()
+
+	b, err := NewBalancer(RoundRobin(), hung.URL)
+	st.Expect(t, err, nil)
+	NewHealthChecker(b, HealthCheck{Passive: true, MaxFails: 2, EjectDuration: time.Minute})
+
+	f, err := New(Balance(b), Timeout(20*time.Millisecond))
+	st.Expect(t, err, nil)
+	proxy := testutils.NewHandler(f.ServeHTTP)
+	defer proxy.Close()
+
+	// upstream timeouts count as failures, ejecting the hung upstream server
+	for i := 0; i < 2; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		st.Expect(t, err, nil)
+		st.Expect(t, re.StatusCode, http.StatusGatewayTimeout)
+	}
+	st.Expect(t, b.Health()[0].Healthy, false)
+}
+
+func TestHealthCheckPassiveClientErrors(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	b, err := NewBalancer(RoundRobin(), srv.URL)
+	st.Expect(t, err, nil)
+	NewHealthChecker(b, HealthCheck{Passive: true, MaxFails: 3, EjectDuration: time.Minute})
+
+	f, err := New(Balance(b), MaxRequestBytes(10))
+	st.Expect(t, err, nil)
+	proxy := testutils.NewHandler(f.ServeHTTP)
+	defer proxy.Close()
+
+	// oversized request bodies of unknown length are client errors,
+	// so they never eject the upstream server
+	for i := 0; i < 3; i++ {
+		body := io.MultiReader(strings.NewReader(strings.Repeat("a", 100)))
+		re, err := http.Post(proxy.URL, "text/plain", body)
+		st.Expect(t, err, nil)
+		re.Body.Close()
+		st.Expect(t, re.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	st.Expect(t, b.Health()[0].Healthy, true)
+	st.Expect(t, b.Health()[0].Fails, 0)
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+}
@@ -1,11 +1,14 @@
 package forward
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/vinxi/utils.v0"
@@ -14,17 +17,205 @@ import (
 // httpForwarder is a handler that can reverse proxy
 // HTTP traffic
 type httpForwarder struct {
-	roundTripper http.RoundTripper
-	rewriter     ReqRewriter
-	passHost     bool
+	roundTripper          http.RoundTripper
+	rewriter              ReqRewriter
+	respRewriters         []RespRewriter
+	passHost              bool
+	flushInterval         time.Duration
+	timeout               time.Duration
+	responseHeaderTimeout time.Duration
+	retry                 *RetryPolicy
+	balancer              *Balancer
+	breaker               *Breaker
+	h2c                   bool
+	grpc                  bool
+	tls                   *tlsConfigs
+	maxRequestBytes       int64
+	maxResponseBytes      int64
+	buffer                *BufferOptions
+	paths                 []pathRewrite
+	queries               []*QueryRewriter
+	reqTransforms         []BodyTransform
+	resTransforms         []BodyTransform
+}
+
+// headerTimer cancels the upstream round trip if the response headers
+// are not received within the timeout once the request has been written.
+type headerTimer struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+	expired bool
+}
+
+// start starts the timer, restarting it on every retry attempt.
+// The request may be fully written after the response is received,
+// such as when the upstream server replies early, so stopped timers are never started.
+func (t *headerTimer) start(httptrace.WroteRequestInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(t.timeout, t.expire)
+}
+
+// received stops the timer once the response headers start being received,
+// until the request is written again by a retry attempt.
+func (t *headerTimer) received() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// expire cancels the upstream round trip, unless it is already done.
+func (t *headerTimer) expire() {
+	t.mu.Lock()
+	expired := !t.stopped
+	t.expired = expired
+	t.mu.Unlock()
+	if expired {
+		t.cancel()
+	}
+}
+
+// stop stops the timer once the round trip is done.
+func (t *headerTimer) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// timedOut returns true if the round trip was cancelled by the timer.
+func (t *headerTimer) timedOut() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.expired
 }
 
 // serveHTTP forwards HTTP traffic using the configured transport
 func (f *httpForwarder) serveHTTP(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
 	start := time.Now().UTC()
-	response, err := f.roundTripper.RoundTrip(f.copyRequest(req, req.URL))
+
+	// Reject oversized request bodies before reaching the upstream server
+	if f.maxRequestBytes > 0 && req.ContentLength > f.maxRequestBytes {
+		ctx.log.Warningf("Request body too large: %d bytes, rejecting request to %v", req.ContentLength, req.URL)
+		ctx.errHandler.ServeHTTP(w, req, ErrRequestTooLarge)
+		return
+	}
+
+	// Reject request bodies the request transforms cannot decode
+	if err := f.checkRequestEncoding(req); err != nil {
+		ctx.log.Warningf("Unsupported request body encoding: %q, rejecting request to %v", req.Header.Get(ContentEncoding), req.URL)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	// Fail fast if the circuit breaker is open
+	if f.breaker != nil && !f.breaker.Allow() {
+		ctx.log.Warningf("Circuit breaker open, rejecting request to %v", req.URL)
+		if f.breaker.options.Fallback != nil {
+			f.breaker.options.Fallback.ServeHTTP(w, req)
+		} else {
+			ctx.errHandler.ServeHTTP(w, req, ErrCircuitOpen)
+		}
+		return
+	}
+
+	// The upstream round trip is cancelled as soon as the client goes away
+	// or the configured timeouts are exceeded.
+	timeout := f.timeout
+	if f.grpc && IsGRPCRequest(req) {
+		if d, ok := grpcTimeout(req.Header); ok && (timeout == 0 || d < timeout) {
+			timeout = d
+		}
+	}
+	var reqCtx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		reqCtx, cancel = context.WithTimeout(req.Context(), timeout)
+	} else {
+		reqCtx, cancel = context.WithCancel(req.Context())
+	}
+	defer cancel()
+
+	// the response headers timeout starts once the request has been written
+	var timer *headerTimer
+	if f.responseHeaderTimeout > 0 {
+		timer = &headerTimer{timeout: f.responseHeaderTimeout, cancel: cancel}
+		reqCtx = httptrace.WithClientTrace(reqCtx, &httptrace.ClientTrace{
+			WroteRequest:         timer.start,
+			GotFirstResponseByte: timer.received,
+		})
+	}
+
+	outReq := f.copyRequest(req, req.URL)
+	// request bodies of unknown length are limited while being sent
+	var reqBody *limitedReader
+	if f.maxRequestBytes > 0 && outReq.ContentLength < 0 && outReq.Body != nil {
+		reqBody = newLimitedReader(outReq.Body, f.maxRequestBytes, ErrRequestTooLarge)
+		outReq.Body = reqBody
+	}
+	f.transformRequest(req, outReq)
+	client := &clientRequest{ctx: req.Context()}
+	if outReq.Body != nil && outReq.Body != http.NoBody {
+		outReq.Body = &clientBody{ReadCloser: outReq.Body, client: client}
+	}
+	tracker := &phaseTracker{}
+	reqCtx = httptrace.WithClientTrace(reqCtx, tracker.trace())
+	reqCtx = context.WithValue(reqCtx, clientContextKey{}, client)
+
+	response, err := f.roundTripper.RoundTrip(outReq.WithContext(reqCtx))
+	if timer != nil {
+		timer.stop()
+	}
+	tooLarge := reqBody != nil && reqBody.tooLarge()
+	// request body errors, such as malformed compressed bodies, are caused by the client
+	bodyErr := client.bodyError()
+	invalidBody := err != nil && bodyErr != nil && !tooLarge
+	if f.breaker != nil {
+		// failures caused by the client release the breaker probe slot
+		// without recording an outcome
+		if tooLarge || invalidBody || req.Context().Err() != nil {
+			f.breaker.Cancel()
+		} else {
+			f.breaker.Record(time.Now().UTC().Sub(start), err != nil || response.StatusCode >= 500)
+		}
+	}
+	if tooLarge {
+		if err == nil {
+			response.Body.Close()
+		}
+		ctx.log.Warningf("Request body too large, aborting request to %v", req.URL)
+		ctx.errHandler.ServeHTTP(w, req, ErrRequestTooLarge)
+		return
+	}
 	if err != nil {
-		fmt.Printf(">> Error: %s \n", err)
+		switch {
+		case req.Context().Err() != nil:
+			ctx.log.Infof("Client cancelled request to %v after %v", req.URL, time.Now().UTC().Sub(start))
+			return
+		case invalidBody:
+			ctx.log.Warningf("Error reading request body, aborting request to %v, err: %v", req.URL, bodyErr)
+			ctx.errHandler.ServeHTTP(w, req, ErrInvalidRequestBody)
+			return
+		case timer != nil && timer.timedOut():
+			err = &timeoutError{"timeout awaiting upstream response headers"}
+		case reqCtx.Err() == context.DeadlineExceeded:
+			err = &timeoutError{"upstream request timeout exceeded"}
+		}
+		err = newError(tracker.get(), tracker.addr(outReq.URL.Host), err)
 		ctx.log.Errorf("Error forwarding to %v, err: %v", req.URL, err)
 		ctx.errHandler.ServeHTTP(w, req, err)
 		return
@@ -42,20 +233,188 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, req *http.Request, ctx
 			req.URL, response.StatusCode, time.Now().UTC().Sub(start))
 	}
 
+	defer response.Body.Close()
+
+	// hop-by-hop headers only apply to the upstream connection
+	RemoveHopHeaders(response.Header, false)
+
+	for _, rw := range f.respRewriters {
+		rw.Rewrite(response, req)
+	}
+
+	if f.maxResponseBytes > 0 {
+		if response.ContentLength > f.maxResponseBytes {
+			err = newError(PhaseReadHeaders, tracker.addr(outReq.URL.Host), ErrResponseTooLarge)
+			ctx.log.Errorf("Upstream response body too large: %d bytes, err: %v", response.ContentLength, err)
+			ctx.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		response.Body = newLimitedReader(response.Body, f.maxResponseBytes, ErrResponseTooLarge)
+	}
+
+	if err = f.transformResponse(req, response); err != nil {
+		err = newError(PhaseReadHeaders, tracker.addr(outReq.URL.Host), err)
+		ctx.log.Errorf("Cannot transform upstream response: %q, err: %v", response.Header.Get(ContentEncoding), err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	// streams cannot be buffered, since they may never end
+	if f.buffer != nil && !isStream(response) {
+		f.serveBuffered(w, req, response, tracker.addr(outReq.URL.Host), ctx)
+		return
+	}
+
 	utils.CopyHeaders(w.Header(), response.Header)
+	// the body length must be known before writing the headers
+	if response.ContentLength >= 0 && bodyAllowedForStatus(response.StatusCode) {
+		w.Header().Set(ContentLength, strconv.FormatInt(response.ContentLength, 10))
+	}
+	announced := announceTrailers(w.Header(), response.Trailer)
 	w.WriteHeader(response.StatusCode)
-	written, err := io.Copy(w, response.Body)
-	defer response.Body.Close()
+	_, err = f.copyResponse(w, response)
 
 	if err != nil {
-		ctx.log.Errorf("Error copying upstream response Body: %v", err)
-		ctx.errHandler.ServeHTTP(w, req, err)
+		if req.Context().Err() != nil {
+			ctx.log.Infof("Client cancelled request to %v while copying the response body", req.URL)
+			return
+		}
+		if err == ErrResponseTooLarge {
+			ctx.log.Errorf("Upstream response body too large, aborting response to %v", req.URL)
+		} else {
+			ctx.log.Errorf("Error copying upstream response Body: %v", err)
+		}
+		// gRPC clients receive the error status as trailers
+		if f.grpc && IsGRPCRequest(req) {
+			ctx.errHandler.ServeHTTP(w, req, newError(PhaseCopyBody, tracker.addr(outReq.URL.Host), err))
+			return
+		}
+		// the headers are already sent: abort the response,
+		// so the client does not mistake it for a complete one
+		panic(http.ErrAbortHandler)
+	}
+
+	// Trailers are available once the upstream body has been fully read
+	copyTrailers(w.Header(), response.Trailer, announced)
+}
+
+// bodyAllowedForStatus returns true if the given response status permits a body,
+// as defined by RFC 7230, section 3.3.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// copyResponse copies the upstream response body to the client,
+// flushing the written data based on the configured flush interval.
+func (f *httpForwarder) copyResponse(w http.ResponseWriter, res *http.Response) (int64, error) {
+	var dst io.Writer = w
+	if interval := flushInterval(res, f.flushInterval); interval != 0 {
+		if flusher, ok := w.(http.Flusher); ok {
+			// streams send the headers right away, since the upstream server
+			// may wait for the client before sending any data
+			if interval == FlushImmediately {
+				flusher.Flush()
+			}
+			fw := newFlushWriter(w, flusher, interval)
+			defer fw.stop()
+			dst = fw
+		}
+	}
+	return io.Copy(dst, res.Body)
+}
+
+// announceTrailers declares the upstream response trailer keys in the
+// client response header, so they can be sent after the body.
+// It returns the number of announced trailers.
+func announceTrailers(h http.Header, trailer http.Header) int {
+	if len(trailer) == 0 {
+		return 0
+	}
+	keys := make([]string, 0, len(trailer))
+	for k := range trailer {
+		keys = append(keys, k)
+	}
+	h.Add(Trailer, strings.Join(keys, ", "))
+	return len(keys)
+}
+
+// copyTrailers copies the upstream response trailers to the client response.
+// Trailers not announced before writing the headers are sent
+// using the http.TrailerPrefix convention.
+func copyTrailers(h http.Header, trailer http.Header, announced int) {
+	if len(trailer) == announced {
+		utils.CopyHeaders(h, trailer)
 		return
 	}
+	for k, vv := range trailer {
+		for _, v := range vv {
+			h.Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// clientContextKey is the upstream request context key storing the client request state.
+type clientContextKey struct{}
+
+// clientRequest stores the state of the client request, telling the failures caused
+// by the client, such as cancellations or request body errors, apart from upstream ones.
+type clientRequest struct {
+	ctx     context.Context
+	mu      sync.Mutex
+	bodyErr error
+	closed  bool
+}
+
+// bodyError returns the error reading the client request body, if any.
+func (c *clientRequest) bodyError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bodyErr
+}
 
-	if written != 0 {
-		w.Header().Set(ContentLength, strconv.FormatInt(written, 10))
+// clientBody records the errors reading the client request body.
+// Errors reading the body once closed by the transport are ignored,
+// such as when the upstream server replies before reading the whole body.
+type clientBody struct {
+	io.ReadCloser
+	client *clientRequest
+}
+
+// Read reads the client request body, recording the read error, if any.
+func (b *clientBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.client.mu.Lock()
+		if !b.client.closed && b.client.bodyErr == nil {
+			b.client.bodyErr = err
+		}
+		b.client.mu.Unlock()
 	}
+	return n, err
+}
+
+// Close closes the client request body.
+func (b *clientBody) Close() error {
+	b.client.mu.Lock()
+	b.client.closed = true
+	b.client.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// clientFailed returns true if the given upstream request failed because of the client,
+// either because the client went away or because its request body cannot be read,
+// such as an oversized body.
+func clientFailed(req *http.Request) bool {
+	if c, ok := req.Context().Value(clientContextKey{}).(*clientRequest); ok {
+		return c.ctx.Err() != nil || c.bodyError() != nil
+	}
+	return req.Context().Err() == context.Canceled
 }
 
 // copyRequest makes a copy of the specified request to be sent using the configured
@@ -64,22 +423,32 @@ func (f *httpForwarder) copyRequest(req *http.Request, u *url.URL) *http.Request
 	outReq := new(http.Request)
 	*outReq = *req // includes shallow copies of maps, but we handle this below
 
+	// the outgoing request URI is built from the request URL, which may have been
+	// modified by previous middleware, keeping the original path encoding
 	outReq.URL = utils.CopyURL(req.URL)
 	outReq.URL.Host = u.Host
-	outReq.URL.Opaque = req.RequestURI
 	outReq.URL.Scheme = u.Scheme
 	if outReq.URL.Scheme == "" {
 		outReq.URL.Scheme = "http"
 	}
-	// raw query is already included in RequestURI, so ignore it to avoid dupes
-	outReq.URL.RawQuery = ""
-	// Do not pass client Host header unless optsetter PassHostHeader is set.
+	if len(f.paths) > 0 {
+		rewritePath(outReq.URL, f.paths)
+	}
+	// router captures are stripped even without query rewriters
+	rewriteQuery(outReq.URL, f.queries)
+	// Do not pass client Host header unless optsetter PassHostHeader is set,
+	// keeping it available to the rewriter for the forwarding headers.
 	if !f.passHost {
+		outReq = outReq.WithContext(context.WithValue(outReq.Context(), clientHostKey{}, req.Host))
 		outReq.Host = u.Host
 	}
-	outReq.Proto = "HTTP/1.1"
-	outReq.ProtoMajor = 1
-	outReq.ProtoMinor = 1
+	// HTTP/2 requests keep their protocol version, while the transport
+	// negotiates the protocol used with the upstream server
+	if req.ProtoMajor < 2 {
+		outReq.Proto = "HTTP/1.1"
+		outReq.ProtoMajor = 1
+		outReq.ProtoMinor = 1
+	}
 
 	// Overwrite close flag so we can keep persistent connection for the backend servers
 	outReq.Close = false
@@ -87,8 +456,15 @@ func (f *httpForwarder) copyRequest(req *http.Request, u *url.URL) *http.Request
 	outReq.Header = make(http.Header)
 	utils.CopyHeaders(outReq.Header, req.Header)
 
+	// Request trailers are intentionally shared with the incoming request,
+	// since they are only populated once the client body has been read.
+
 	if f.rewriter != nil {
 		f.rewriter.Rewrite(outReq)
 	}
+	// upstream responses must use an encoding supported by the response transforms
+	if len(f.resTransforms) > 0 {
+		limitAcceptEncoding(outReq.Header)
+	}
 	return outReq
 }
@@ -0,0 +1,101 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestLimitedReader(t *testing.T) {
+	r := newLimitedReader(ioutil.NopCloser(strings.NewReader("hello")), 5, ErrRequestTooLarge)
+	body, err := ioutil.ReadAll(r)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(body), "hello")
+	st.Expect(t, r.tooLarge(), false)
+
+	r = newLimitedReader(ioutil.NopCloser(strings.NewReader("hello world")), 5, ErrRequestTooLarge)
+	body, err = ioutil.ReadAll(r)
+	st.Expect(t, err, ErrRequestTooLarge)
+	st.Expect(t, string(body), "hello")
+	st.Expect(t, r.tooLarge(), true)
+}
+
+func TestForwardContentLength(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 10000)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ContentLength, "10000")
+		w.Write(body)
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL)
+	defer proxy.Close()
+
+	re, data, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.ContentLength, int64(10000))
+	st.Expect(t, len(re.TransferEncoding), 0)
+	st.Expect(t, bytes.Equal(data, body), true)
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	called := false
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+		io.Copy(ioutil.Discard, req.Body)
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL, MaxRequestBytes(5))
+	defer proxy.Close()
+
+	re, _, err := testutils.Post(proxy.URL, testutils.Body("hello"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+
+	called = false
+	re, _, err = testutils.Post(proxy.URL, testutils.Body("hello world"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusRequestEntityTooLarge)
+	st.Expect(t, called, false)
+
+	// bodies of unknown length are limited while being forwarded
+	req, _ := http.NewRequest("POST", proxy.URL, io.MultiReader(strings.NewReader("hello world")))
+	re, err = http.DefaultClient.Do(req)
+	st.Expect(t, err, nil)
+	re.Body.Close()
+	st.Expect(t, req.ContentLength, int64(0))
+	st.Expect(t, re.StatusCode, http.StatusRequestEntityTooLarge)
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("chunked") != "" {
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("hello world"))
+	})
+	defer srv.Close()
+
+	proxy := newTestProxy(t, srv.URL, MaxResponseBytes(10))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusBadGateway)
+
+	// streamed responses are aborted once the headers are sent
+	re, err = http.Get(proxy.URL + "?chunked=true")
+	st.Expect(t, err, nil)
+	_, err = ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Reject(t, err, nil)
+}
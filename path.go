@@ -0,0 +1,82 @@
+package forward
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// pathRewrite rewrites the escaped upstream request path.
+type pathRewrite func(path string) string
+
+// PathPrefix joins the given base path with the upstream request path,
+// such as "/api/v2" forwarding "/users" to "/api/v2/users".
+func PathPrefix(prefix string) OptSetter {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return pathRewriter(func(path string) string {
+		if prefix == "" {
+			return path
+		}
+		if path == "" || path == "/" {
+			return prefix + path
+		}
+		return prefix + "/" + strings.TrimPrefix(path, "/")
+	})
+}
+
+// StripPrefix removes the given prefix from the upstream request path,
+// such as "/users" forwarding "/users/123" to "/123".
+// The prefix matches whole path segments only, so paths such as "/usersettings"
+// are forwarded as they are, like any other path without the prefix.
+func StripPrefix(prefix string) OptSetter {
+	return pathRewriter(func(path string) string {
+		if !strings.HasPrefix(path, prefix) {
+			return path
+		}
+		if len(path) > len(prefix) && path[len(prefix)] != '/' && !strings.HasSuffix(prefix, "/") {
+			return path
+		}
+		path = path[len(prefix):]
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return path
+	})
+}
+
+// RewritePath replaces the upstream request path matches of the given regular expression
+// with the given replacement, which can reference the capture groups, such as "$1".
+// Path rewrites are applied in the order they are defined.
+func RewritePath(pattern, replacement string) OptSetter {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return func(f *Forwarder) error {
+			return err
+		}
+	}
+	return pathRewriter(func(path string) string {
+		return re.ReplaceAllString(path, replacement)
+	})
+}
+
+// pathRewriter returns an OptSetter adding the given path rewrite
+// to both the HTTP and websocket forwarders.
+func pathRewriter(rewrite pathRewrite) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.paths = append(f.httpForwarder.paths, rewrite)
+		f.websocketForwarder.paths = append(f.websocketForwarder.paths, rewrite)
+		return nil
+	}
+}
+
+// rewritePath applies the given path rewrites to the given URL,
+// keeping the original path encoding.
+func rewritePath(u *url.URL, rewrites []pathRewrite) {
+	path := u.EscapedPath()
+	for _, rewrite := range rewrites {
+		path = rewrite(path)
+	}
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		u.Path, u.RawPath = unescaped, path
+	}
+}
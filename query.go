@@ -0,0 +1,162 @@
+package forward
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// QueryRewriter declares the query parameter changes applied to the upstream requests.
+// Changes are applied in the following order: Rename, Remove, Set and Add.
+//
+// The path params captured by the router, which are named with a leading colon,
+// such as ":id", are never forwarded, unless they are renamed, such as ":id" to "id".
+type QueryRewriter struct {
+	// Rename maps the parameter names to their new names.
+	Rename map[string]string
+	// Remove defines the parameters to remove.
+	Remove []string
+	// Set defines the parameters to set, replacing any existing value.
+	Set map[string]string
+	// Add defines the parameter values to add, keeping any existing value.
+	Add map[string]string
+}
+
+// RewriteQuery defines a query rewriter for the upstream requests.
+// Query rewriters are applied in the order they are defined.
+// Only the affected parameters are changed: the rest of the query string
+// is forwarded as it is, keeping its order and encoding.
+func RewriteQuery(rw *QueryRewriter) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.queries = append(f.httpForwarder.queries, rw)
+		f.websocketForwarder.queries = append(f.websocketForwarder.queries, rw)
+		return nil
+	}
+}
+
+// queryPair stores a query parameter, keeping its original encoding.
+type queryPair struct {
+	key      string
+	rawKey   string
+	rawValue string
+}
+
+// rewriteQuery applies the given query rewriters to the given URL,
+// stripping the remaining router captures afterwards.
+// The raw query is left unchanged if no parameter is affected.
+func rewriteQuery(u *url.URL, rewriters []*QueryRewriter) {
+	pairs := parseQueryPairs(u.RawQuery)
+	changed := false
+	for _, rw := range rewriters {
+		var c bool
+		pairs, c = rw.rewritePairs(pairs)
+		changed = changed || c
+	}
+	var stripped []queryPair
+	for _, p := range pairs {
+		if strings.HasPrefix(p.key, ":") {
+			changed = true
+			continue
+		}
+		stripped = append(stripped, p)
+	}
+	if !changed {
+		return
+	}
+	pairs = stripped
+	raw := make([]string, len(pairs))
+	for i, p := range pairs {
+		raw[i] = p.rawKey + p.rawValue
+	}
+	u.RawQuery = strings.Join(raw, "&")
+}
+
+// parseQueryPairs splits the given raw query into its parameters.
+// Keys which cannot be unescaped are matched as they are.
+func parseQueryPairs(rawQuery string) []queryPair {
+	if rawQuery == "" {
+		return nil
+	}
+	var pairs []queryPair
+	for _, raw := range strings.Split(rawQuery, "&") {
+		p := queryPair{rawKey: raw}
+		if i := strings.IndexByte(raw, '='); i >= 0 {
+			p.rawKey, p.rawValue = raw[:i], raw[i:]
+		}
+		p.key = p.rawKey
+		if key, err := url.QueryUnescape(p.rawKey); err == nil {
+			p.key = key
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs
+}
+
+// newQueryPair creates a new query parameter with the given key and value.
+func newQueryPair(key, value string) queryPair {
+	return queryPair{key: key, rawKey: url.QueryEscape(key), rawValue: "=" + url.QueryEscape(value)}
+}
+
+// rewritePairs applies the changes to the given query parameters,
+// returning true if any parameter was changed.
+func (rw *QueryRewriter) rewritePairs(pairs []queryPair) ([]queryPair, bool) {
+	changed := false
+	set := make(map[string]bool)
+	var result []queryPair
+	for _, p := range pairs {
+		if p.rawKey == "" && p.rawValue == "" {
+			result = append(result, p)
+			continue
+		}
+		if to, ok := rw.Rename[p.key]; ok {
+			p.key, p.rawKey = to, url.QueryEscape(to)
+			changed = true
+		}
+		if contains(rw.Remove, p.key) {
+			changed = true
+			continue
+		}
+		if value, ok := rw.Set[p.key]; ok {
+			changed = true
+			// the first value is replaced in place, removing the others
+			if set[p.key] {
+				continue
+			}
+			set[p.key] = true
+			p = newQueryPair(p.key, value)
+		}
+		result = append(result, p)
+	}
+	for _, key := range sortedKeys(rw.Set) {
+		if !set[key] {
+			result = append(result, newQueryPair(key, rw.Set[key]))
+			changed = true
+		}
+	}
+	for _, key := range sortedKeys(rw.Add) {
+		result = append(result, newQueryPair(key, rw.Add[key]))
+		changed = true
+	}
+	return result, changed
+}
+
+// contains returns true if the given list contains the given value.
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of the given map in order,
+// so the added parameters do not depend on the map iteration order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,156 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"gopkg.in/vinxi/utils.v0"
+)
+
+// RetryPolicy defines how failed upstream round trips are retried.
+type RetryPolicy struct {
+	// Attempts defines the maximum number of attempts, including the first one.
+	Attempts int
+	// Backoff returns the delay to wait before the given retry attempt.
+	// Retries are performed immediately if no backoff function is defined.
+	Backoff func(attempt int) time.Duration
+	// RetryStatus reports if the given upstream response status code should be retried.
+	// Only network errors are retried if no function is defined.
+	RetryStatus func(status int) bool
+	// NonIdempotent enables retrying non-idempotent requests, such as POST.
+	// By default, only idempotent requests are retried.
+	NonIdempotent bool
+	// MaxBodyBytes defines the maximum request body size buffered in memory
+	// in order to replay it. Requests with larger bodies are never retried.
+	MaxBodyBytes int64
+}
+
+// ConstantBackoff returns a backoff function that always waits the given delay.
+func ConstantBackoff(delay time.Duration) func(int) time.Duration {
+	return func(int) time.Duration {
+		return delay
+	}
+}
+
+// ExponentialBackoff returns a backoff function that doubles the given
+// base delay on every retry attempt, up to the given max delay.
+func ExponentialBackoff(base, max time.Duration) func(int) time.Duration {
+	return func(attempt int) time.Duration {
+		delay := base
+		for i := 1; i < attempt && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			return max
+		}
+		return delay
+	}
+}
+
+// idempotentMethods stores the HTTP methods considered idempotent.
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+// isIdempotent returns true if the given request can be safely retried.
+func isIdempotent(req *http.Request) bool {
+	if idempotentMethods[req.Method] {
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	return ok
+}
+
+// retryRoundTripper is an http.RoundTripper that retries failed
+// round trips based on the given retry policy.
+type retryRoundTripper struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+	log    utils.Logger
+}
+
+// RoundTrip performs the round trip, retrying it if required.
+func (rt *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.policy.Attempts < 2 || (!rt.policy.NonIdempotent && !isIdempotent(req)) {
+		return rt.next.RoundTrip(req)
+	}
+
+	body, rest, err := rt.bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if rest != nil {
+		outReq := new(http.Request)
+		*outReq = *req
+		outReq.Body = rest
+		return rt.next.RoundTrip(outReq)
+	}
+
+	for attempt := 1; ; attempt++ {
+		outReq := req
+		if body != nil {
+			outReq = new(http.Request)
+			*outReq = *req
+			outReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		res, err := rt.next.RoundTrip(outReq)
+		if attempt >= rt.policy.Attempts || req.Context().Err() != nil {
+			return res, err
+		}
+		if err == nil {
+			if rt.policy.RetryStatus == nil || !rt.policy.RetryStatus(res.StatusCode) {
+				return res, nil
+			}
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			rt.log.Warningf("Retrying request to %v, attempt: %d, code: %v", req.URL, attempt+1, res.StatusCode)
+		} else {
+			rt.log.Warningf("Retrying request to %v, attempt: %d, err: %v", req.URL, attempt+1, err)
+		}
+
+		if rt.policy.Backoff != nil {
+			select {
+			case <-time.After(rt.policy.Backoff(attempt)):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+	}
+}
+
+// bufferBody reads the request body in memory so it can be replayed.
+// If the body exceeds the configured limit, it returns a reader with the
+// full body in order to forward the request without retries.
+func (rt *retryRoundTripper) bufferBody(req *http.Request) ([]byte, io.ReadCloser, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil, nil
+	}
+	if req.ContentLength > rt.policy.MaxBodyBytes {
+		return nil, req.Body, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, rt.policy.MaxBodyBytes+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(body)) > rt.policy.MaxBodyBytes {
+		return nil, &readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}, nil
+	}
+	req.Body.Close()
+	return body, nil, nil
+}
+
+// readCloser combines an io.Reader and an io.Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
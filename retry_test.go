@@ -0,0 +1,133 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	st.Expect(t, backoff(1), 10*time.Millisecond)
+	st.Expect(t, backoff(2), 20*time.Millisecond)
+	st.Expect(t, backoff(3), 40*time.Millisecond)
+	st.Expect(t, backoff(4), 50*time.Millisecond)
+	st.Expect(t, ConstantBackoff(time.Second)(5), time.Second)
+}
+
+func TestRetryConnectionReset(t *testing.T) {
+	var calls int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(Retry(RetryPolicy{Attempts: 3, Backoff: ConstantBackoff(time.Millisecond)}))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, string(body), "hello")
+	st.Expect(t, atomic.LoadInt32(&calls), int32(2))
+}
+
+func TestRetryNonIdempotent(t *testing.T) {
+	var calls int32
+	var received string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = string(body)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	policy := RetryPolicy{
+		Attempts:     2,
+		MaxBodyBytes: 1024,
+		RetryStatus: func(status int) bool {
+			return status == http.StatusServiceUnavailable
+		},
+	}
+
+	f, err := New(Retry(policy))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// POST requests are not retried by default
+	re, _, err := testutils.Post(proxy.URL, testutils.Body("payload"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusServiceUnavailable)
+	st.Expect(t, atomic.LoadInt32(&calls), int32(1))
+
+	atomic.StoreInt32(&calls, 0)
+	policy.NonIdempotent = true
+	f, err = New(Retry(policy))
+	st.Expect(t, err, nil)
+
+	re, body, err := testutils.Post(proxy.URL, testutils.Body("payload"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, string(body), "hello")
+	st.Expect(t, received, "payload")
+	st.Expect(t, atomic.LoadInt32(&calls), int32(2))
+}
+
+func TestRetryBodyLimit(t *testing.T) {
+	var calls int32
+	var received string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received = string(body)
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer srv.Close()
+
+	f, err := New(Retry(RetryPolicy{
+		Attempts:      3,
+		MaxBodyBytes:  4,
+		NonIdempotent: true,
+		RetryStatus: func(status int) bool {
+			return status == http.StatusServiceUnavailable
+		},
+	}))
+	st.Expect(t, err, nil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Post(proxy.URL, testutils.Body("payload"))
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusServiceUnavailable)
+	st.Expect(t, received, "payload")
+	st.Expect(t, atomic.LoadInt32(&calls), int32(1))
+}
@@ -1,6 +1,8 @@
 package forward
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
@@ -10,22 +12,61 @@ import (
 
 // HeaderRewriter is responsible for removing hop-by-hop headers and setting forwarding headers.
 type HeaderRewriter struct {
+	// TrustForwardHeader trusts the forwarded headers sent by any client,
+	// unless TrustedProxies is defined.
 	TrustForwardHeader bool
-	Hostname           string
+	// TrustedProxies defines the networks of the proxies whose forwarded headers are trusted.
+	// Forwarded headers sent by any other client are replaced.
+	TrustedProxies []*net.IPNet
+	// Forwarded defines the forwarding headers to generate. Defaults to ForwardedLegacy.
+	Forwarded ForwardedMode
+	// ForwardedBy defines the proxy identifier used as by parameter of the Forwarded header,
+	// such as an obfuscated identifier like "_proxy1". Defaults to the local server address.
+	ForwardedBy string
+	Hostname    string
 }
 
 // Rewrite rewrites the given request removing hop-by-hop headers and setting forwarding headers.
 func (rw *HeaderRewriter) Rewrite(req *http.Request) {
-	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		if rw.TrustForwardHeader {
-			if prior, ok := req.Header[XForwardedFor]; ok {
-				clientIP = strings.Join(prior, ", ") + ", " + clientIP
-			}
+	// Remove hop-by-hop headers to the backend before setting the forwarding
+	// headers, so clients cannot remove them listing them as Connection tokens.
+	// Especially important is "Connection" because we want a persistent
+	// connection, regardless of what the client sent to us.
+	trailers := headerContainsToken(req.Header, Te, "trailers")
+	RemoveHopHeaders(req.Header, false)
+
+	// Let the backend know the client accepts trailers,
+	// which is required by protocols like gRPC.
+	if trailers {
+		req.Header.Set(Te, "trailers")
+	}
+
+	trusted := rw.trusted(remoteIP(req.RemoteAddr))
+
+	if rw.Forwarded != ForwardedStandard {
+		rw.setForwardedFor(req, trusted)
+	} else {
+		utils.RemoveHeaders(req.Header, XForwardedFor, XForwardedProto, XForwardedHost, XForwardedServer)
+	}
+
+	if rw.Forwarded != ForwardedLegacy {
+		rw.setForwarded(req, trusted)
+	} else if !trusted {
+		req.Header.Del(Forwarded)
+	}
+}
+
+// setForwardedFor sets the X-Forwarded-* headers of the given request,
+// keeping the values sent by trusted clients.
+func (rw *HeaderRewriter) setForwardedFor(req *http.Request, trusted bool) {
+	if clientIP := remoteIP(req.RemoteAddr); clientIP != "" {
+		if prior, ok := req.Header[XForwardedFor]; ok && trusted {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
 		}
 		req.Header.Set(XForwardedFor, clientIP)
 	}
 
-	if xfp := req.Header.Get(XForwardedProto); xfp != "" && rw.TrustForwardHeader {
+	if xfp := req.Header.Get(XForwardedProto); xfp != "" && trusted {
 		req.Header.Set(XForwardedProto, xfp)
 	} else if req.TLS != nil {
 		req.Header.Set(XForwardedProto, "https")
@@ -33,19 +74,137 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 		req.Header.Set(XForwardedProto, "http")
 	}
 
-	if xfh := req.Header.Get(XForwardedHost); xfh != "" && rw.TrustForwardHeader {
+	if xfh := req.Header.Get(XForwardedHost); xfh != "" && trusted {
 		req.Header.Set(XForwardedHost, xfh)
-	} else if req.Host != "" {
-		req.Header.Set(XForwardedHost, req.Host)
+	} else if host := clientHost(req); host != "" {
+		req.Header.Set(XForwardedHost, host)
 	}
 
 	if rw.Hostname != "" {
 		req.Header.Set(XForwardedServer, rw.Hostname)
 	}
+}
 
-	// Remove hop-by-hop headers to the backend.
-	// Especially important is "Connection" because we want a persistent
-	// connection, regardless of what the client sent to us.
-	// fmt.Printf(">> %#v \n", req.Header)
-	utils.RemoveHeaders(req.Header, HopHeaders...)
+// clientHostKey is the request context key storing the client Host header,
+// when replaced by the upstream host in the outgoing request.
+type clientHostKey struct{}
+
+// clientHost returns the Host header sent by the client of the given request.
+func clientHost(req *http.Request) string {
+	if host, ok := req.Context().Value(clientHostKey{}).(string); ok {
+		return host
+	}
+	return req.Host
+}
+
+// ClientIP returns the real client IP of the given request. If the request comes
+// from a trusted proxy, the forwarded chain is walked from the right,
+// skipping the trusted proxies, otherwise the remote address is returned.
+func (rw *HeaderRewriter) ClientIP(req *http.Request) string {
+	client := remoteIP(req.RemoteAddr)
+	if client == "" || !rw.trusted(client) {
+		return client
+	}
+	chain := rw.forwardedChain(req)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := remoteIP(chain[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		client = ip
+		if !rw.trusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedChain returns the client addresses sent in the forwarding headers,
+// preferring the Forwarded header unless the legacy mode is used.
+func (rw *HeaderRewriter) forwardedChain(req *http.Request) []string {
+	if rw.Forwarded != ForwardedLegacy {
+		if elements := ParseForwarded(req.Header); len(elements) > 0 {
+			chain := make([]string, len(elements))
+			for i, e := range elements {
+				chain[i] = e.For
+			}
+			return chain
+		}
+		if rw.Forwarded == ForwardedStandard {
+			return nil
+		}
+	}
+	return headerTokens(req.Header, XForwardedFor)
+}
+
+// trusted returns true if the forwarded headers sent by the given IP are trusted.
+func (rw *HeaderRewriter) trusted(ip string) bool {
+	if len(rw.TrustedProxies) == 0 {
+		return rw.TrustForwardHeader
+	}
+	parsed := net.ParseIP(ip)
+	for _, network := range rw.TrustedProxies {
+		if parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP of the given address, removing the port if present.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// ParseCIDRs parses the given networks in CIDR notation.
+// Single IP addresses are parsed as networks containing only that address.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("forward: invalid IP address: %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// clientIPKey is the request context key storing the real client IP.
+type clientIPKey struct{}
+
+// RealIP returns a middleware storing the real client IP, computed by the given
+// rewriter, in the request context, making it available to the next handlers
+// via ClientIP.
+func RealIP(rw *HeaderRewriter) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := context.WithValue(req.Context(), clientIPKey{}, rw.ClientIP(req))
+			h.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// ClientIP returns the real client IP stored by the RealIP middleware,
+// or the remote IP if not available.
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(req.RemoteAddr)
 }
@@ -1 +1,95 @@
 package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbio/st"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := ParseCIDRs("10.0.0.0/8", "192.168.1.1", "::1")
+	st.Expect(t, err, nil)
+	st.Expect(t, len(networks), 3)
+	st.Expect(t, networks[1].String(), "192.168.1.1/32")
+	st.Expect(t, networks[2].String(), "::1/128")
+
+	_, err = ParseCIDRs("invalid")
+	st.Reject(t, err, nil)
+	_, err = ParseCIDRs("10.0.0.0/33")
+	st.Reject(t, err, nil)
+}
+
+func TestHeaderRewriterTrustedProxies(t *testing.T) {
+	networks, _ := ParseCIDRs("10.0.0.0/8")
+	rw := &HeaderRewriter{TrustedProxies: networks}
+
+	cases := []struct {
+		remoteAddr string
+		xff        string
+		proto      string
+	}{
+		{"10.0.0.1:1234", "1.2.3.4, 10.0.0.1", "https"},
+		{"8.8.8.8:1234", "8.8.8.8", "http"},
+	}
+	for _, c := range cases {
+		req := &http.Request{RemoteAddr: c.remoteAddr, Host: "proxy.com", Header: http.Header{}}
+		req.Header.Set(XForwardedFor, "1.2.3.4")
+		req.Header.Set(XForwardedProto, "https")
+		req.Header.Set(XForwardedHost, "spoofed.com")
+		rw.Rewrite(req)
+		st.Expect(t, req.Header.Get(XForwardedFor), c.xff)
+		st.Expect(t, req.Header.Get(XForwardedProto), c.proto)
+	}
+
+	// TrustForwardHeader is ignored when trusted proxies are defined
+	rw.TrustForwardHeader = true
+	req := &http.Request{RemoteAddr: "8.8.8.8:1234", Host: "proxy.com", Header: http.Header{}}
+	req.Header.Set(XForwardedHost, "spoofed.com")
+	rw.Rewrite(req)
+	st.Expect(t, req.Header.Get(XForwardedHost), "proxy.com")
+}
+
+func TestHeaderRewriterClientIP(t *testing.T) {
+	networks, _ := ParseCIDRs("10.0.0.0/8", "192.168.0.0/16")
+	rw := &HeaderRewriter{TrustedProxies: networks}
+
+	cases := []struct {
+		remoteAddr string
+		xff        string
+		expected   string
+	}{
+		{"8.8.8.8:1234", "1.2.3.4", "8.8.8.8"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:1234", "1.2.3.4, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"10.0.0.1:1234", "192.168.1.2, 10.0.0.2", "192.168.1.2"},
+		{"10.0.0.1:1234", "1.2.3.4, invalid, 10.0.0.2", "10.0.0.2"},
+		{"[::1]:1234", "1.2.3.4", "::1"},
+	}
+	for _, c := range cases {
+		req := &http.Request{RemoteAddr: c.remoteAddr, Header: http.Header{}}
+		if c.xff != "" {
+			req.Header.Set(XForwardedFor, c.xff)
+		}
+		st.Expect(t, rw.ClientIP(req), c.expected)
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	networks, _ := ParseCIDRs("10.0.0.0/8")
+	var ip string
+	h := RealIP(&HeaderRewriter{TrustedProxies: networks})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip = ClientIP(req)
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set(XForwardedFor, "1.2.3.4")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	st.Expect(t, ip, "1.2.3.4")
+
+	// without the middleware, the remote IP is used
+	st.Expect(t, ClientIP(req), "10.0.0.1")
+}
@@ -46,8 +46,9 @@ func (r *Route) Match(path string) (url.Values, bool) {
 }
 
 // Forward defines the default URL to forward incoming traffic.
-func (r *Route) Forward(uri string) {
-	r.Layer.UseFinalHandler(http.HandlerFunc(forward.To(uri)))
+// Options such as forward.StripPrefix can map the route paths onto the backend paths.
+func (r *Route) Forward(uri string, opts ...forward.OptSetter) {
+	r.Layer.UseFinalHandler(http.HandlerFunc(forward.To(uri, opts...)))
 }
 
 // Use attaches a new middleware handler for incoming HTTP traffic.
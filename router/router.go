@@ -127,8 +127,9 @@ func New() *Router {
 }
 
 // Forward defines the default URL to forward incoming traffic.
-func (r *Router) Forward(uri string) *Router {
-	r.Layer.UseFinalHandler(http.HandlerFunc(forward.To(uri)))
+// Options such as forward.StripPrefix can map the request paths onto the backend paths.
+func (r *Router) Forward(uri string, opts ...forward.OptSetter) *Router {
+	r.Layer.UseFinalHandler(http.HandlerFunc(forward.To(uri, opts...)))
 	return r
 }
 
@@ -260,7 +261,11 @@ func (r *Router) Remove(method, path string) bool {
 func (r *Router) HandleHTTP(w http.ResponseWriter, req *http.Request, h http.Handler) {
 	if params, route := r.match(req.Method, req.URL.Path); route != nil {
 		if len(params) > 0 {
-			req.URL.RawQuery = url.Values(params).Encode() + "&" + req.URL.RawQuery
+			query := url.Values(params).Encode()
+			if req.URL.RawQuery != "" {
+				query += "&" + req.URL.RawQuery
+			}
+			req.URL.RawQuery = query
 		}
 		r.Layer.Run(layer.RequestPhase, w, req, route)
 		return
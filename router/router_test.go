@@ -47,6 +47,20 @@ func TestRoutingHit(t *testing.T) {
 	}
 }
 
+func TestRoutingCapturesQuery(t *testing.T) {
+	p := New()
+
+	var query string
+	p.Get("/foo/:name").Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+	}))
+
+	p.HandleHTTP(nil, newRequest("GET", "/foo/keith?a=b", nil), nil)
+	st.Expect(t, query, "%3Aname=keith&a=b")
+	p.HandleHTTP(nil, newRequest("GET", "/foo/keith", nil), nil)
+	st.Expect(t, query, "%3Aname=keith")
+}
+
 func TestRoutingMethodNotAllowed(t *testing.T) {
 	p := New()
 	p.ForceMethodNotAllowed = true
@@ -1,9 +1,12 @@
 package vinxi
 
 import (
+	"context"
 	"net/http"
 	"strconv"
 	"time"
+
+	"gopkg.in/vinxi/forward.v0"
 )
 
 var (
@@ -39,6 +42,10 @@ type Server struct {
 
 	// Options stores the server start options.
 	Options ServerOptions
+
+	// Tunnels stores the registry of the active websocket tunnels of the server,
+	// used by its forwarders without a registry of their own.
+	Tunnels *forward.Tunnels
 }
 
 // NewServer creates a new standard HTTP server.
@@ -63,17 +70,25 @@ func NewServer(o ServerOptions) *Server {
 	}
 
 	vinxi := New()
-	vinxi.BindServer(svr)
-
 	if o.Forward != "" {
 		vinxi.Forward(o.Forward)
 	}
 
-	return &Server{
+	s := &Server{
 		Options: o,
 		Server:  svr,
 		Vinxi:   vinxi,
+		Tunnels: forward.NewTunnels(),
 	}
+	svr.Handler = s
+	return s
+}
+
+// ServeHTTP implements the http.Handler interface, serving the incoming traffic
+// with the server vinxi instance. The server tunnels registry is given to the forwarders
+// via the request context, so shutting down the server only drains its own tunnels.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Vinxi.ServeHTTP(w, r.WithContext(forward.WithTunnels(r.Context(), s.Tunnels)))
 }
 
 // Forward defines the default URL to forward incoming traffic.
@@ -94,3 +109,17 @@ func (s *Server) Listen() error {
 	}
 	return s.Server.ListenAndServe()
 }
+
+// Shutdown gracefully shuts down the server without interrupting any active
+// connection, including the websocket tunnels, which are closed with a going
+// away close frame. Once the context is done, the remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	drained := make(chan error, 1)
+	go func() { drained <- s.Tunnels.Drain(ctx) }()
+
+	err := s.Server.Shutdown(ctx)
+	if derr := <-drained; err == nil {
+		err = derr
+	}
+	return err
+}
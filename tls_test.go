@@ -0,0 +1,200 @@
+package forward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+	"golang.org/x/net/websocket"
+)
+
+// writeCertificate generates a self-signed certificate with the given common name,
+// writing the PEM encoded certificate and key to the given directory.
+func writeCertificate(t *testing.T, dir, name string, modTime time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	st.Expect(t, err, nil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	st.Expect(t, err, nil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	st.Expect(t, err, nil)
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+	return certFile, keyFile
+}
+
+// writeCA writes the certificate of the given test server as CA file.
+func writeCA(t *testing.T, dir string, srv *httptest.Server) string {
+	file := filepath.Join(dir, "ca.crt")
+	err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	st.Expect(t, err, nil)
+	return file
+}
+
+func TestUpstreamTLSVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "forward")
+	defer os.RemoveAll(dir)
+	ca := writeCA(t, dir, srv)
+
+	cases := []struct {
+		options TLSOptions
+		status  int
+	}{
+		{TLSOptions{}, http.StatusBadGateway},
+		{TLSOptions{CAFiles: []string{ca}}, http.StatusOK},
+		{TLSOptions{CAFiles: []string{ca}, ServerName: "example.com"}, http.StatusOK},
+		{TLSOptions{CAFiles: []string{ca}, ServerName: "invalid.com"}, http.StatusBadGateway},
+		{TLSOptions{InsecureSkipVerify: true}, http.StatusOK},
+		{TLSOptions{CAFiles: []string{ca}, Pins: []string{SPKIPin(srv.Certificate())}}, http.StatusOK},
+		{TLSOptions{InsecureSkipVerify: true, Pins: []string{SPKIPin(srv.Certificate())}}, http.StatusOK},
+		{TLSOptions{InsecureSkipVerify: true, Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}, http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		proxy := newTestProxy(t, srv.URL, TLS(c.options))
+		re, _, err := testutils.Get(proxy.URL)
+		proxy.Close()
+		st.Expect(t, err, nil)
+		st.Expect(t, re.StatusCode, c.status)
+	}
+}
+
+func TestUpstreamTLSPerHost(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	host := testutils.ParseURI(srv.URL).Host
+	proxy := newTestProxy(t, srv.URL, TLS(TLSOptions{}), UpstreamTLS(host, TLSOptions{InsecureSkipVerify: true}))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, string(body), "hello")
+}
+
+func TestUpstreamTLSSharedTransport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	first, second := httptest.NewTLSServer(handler), httptest.NewTLSServer(handler)
+	defer first.Close()
+	defer second.Close()
+
+	dir, _ := ioutil.TempDir("", "forward")
+	defer os.RemoveAll(dir)
+	ca := writeCA(t, dir, first)
+
+	f, err := New(TLS(TLSOptions{CAFiles: []string{ca}}), UpstreamTLS("localhost", TLSOptions{InsecureSkipVerify: true}))
+	st.Expect(t, err, nil)
+	rt := f.httpForwarder.roundTripper.(*tlsRoundTripper)
+
+	// upstream hosts using the same configuration share the transport,
+	// while the certificates are still verified against each host
+	_, port, _ := net.SplitHostPort(testutils.ParseURI(second.URL).Host)
+	for _, target := range []string{first.URL, second.URL, "https://localhost:" + port} {
+		req, _ := http.NewRequest("GET", target, nil)
+		res, err := rt.RoundTrip(req)
+		st.Expect(t, err, nil)
+		st.Expect(t, res.StatusCode, http.StatusOK)
+		res.Body.Close()
+	}
+	st.Expect(t, len(rt.transports), 2)
+}
+
+func TestUpstreamTLSClientCertificateReload(t *testing.T) {
+	var names []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		names = append(names, req.TLS.PeerCertificates[0].Subject.CommonName)
+		// a new connection is required to present a new client certificate
+		w.Header().Set(Connection, "close")
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "forward")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir, "first", time.Now().Add(-time.Minute))
+
+	options := TLSOptions{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true, ReloadInterval: time.Nanosecond}
+	proxy := newTestProxy(t, srv.URL, TLS(options))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+
+	writeCertificate(t, dir, "second", time.Now())
+	re, _, err = testutils.Get(proxy.URL)
+	st.Expect(t, err, nil)
+	st.Expect(t, re.StatusCode, http.StatusOK)
+	st.Expect(t, names, []string{"first", "second"})
+}
+
+func TestUpstreamTLSInvalidOptions(t *testing.T) {
+	_, err := New(TLS(TLSOptions{CertFile: "client.crt"}))
+	st.Reject(t, err, nil)
+	_, err = New(TLS(TLSOptions{Pins: []string{"invalid"}}))
+	st.Reject(t, err, nil)
+	_, err = New(TLS(TLSOptions{CAFiles: []string{"missing.crt"}}))
+	st.Reject(t, err, nil)
+	_, err = New(TLS(TLSOptions{}), RoundTripper(http.DefaultTransport))
+	st.Reject(t, err, nil)
+}
+
+func TestUpstreamTLSWebsocket(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		conn.Write([]byte("ok"))
+		conn.Close()
+	}))
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "forward")
+	defer os.RemoveAll(dir)
+	ca := writeCA(t, dir, srv)
+
+	proxy := newTestProxy(t, srv.URL, TLS(TLSOptions{CAFiles: []string{ca}, ServerName: "example.com"}))
+	defer proxy.Close()
+
+	conn, err := websocket.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", "", "http://localhost")
+	st.Expect(t, err, nil)
+	msg := make([]byte, 2)
+	_, err = conn.Read(msg)
+	conn.Close()
+	st.Expect(t, err, nil)
+	st.Expect(t, string(msg), "ok")
+}
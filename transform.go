@@ -0,0 +1,331 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// ErrUnsupportedEncoding is returned when a body matching a transform uses
+// a content encoding that cannot be transformed, such as zstd.
+var ErrUnsupportedEncoding = errors.New("forward: unsupported content encoding")
+
+// BodyTransformer transforms request or response bodies while they are streamed.
+type BodyTransformer interface {
+	// Transform returns a reader transforming the given decompressed body.
+	// The whole body should not be buffered, since it may be large.
+	Transform(req *http.Request, body io.Reader) io.Reader
+}
+
+// BodyTransformerFunc is an adapter to use ordinary functions as BodyTransformer.
+type BodyTransformerFunc func(req *http.Request, body io.Reader) io.Reader
+
+// Transform calls f(req, body).
+func (f BodyTransformerFunc) Transform(req *http.Request, body io.Reader) io.Reader {
+	return f(req, body)
+}
+
+// BodyTransform defines a chain of body transformers applied to the bodies
+// of the given content types.
+//
+// Compressed bodies are decompressed before being transformed and compressed
+// again using the same encoding. The gzip, deflate and br encodings are supported:
+// requests using any other encoding are rejected with ErrUnsupportedEncoding,
+// while such upstream responses are replaced by an ErrUnsupportedEncoding forwarding error.
+// Requests whose body cannot be decoded are rejected with ErrInvalidRequestBody.
+// Bodies not matching any transform are forwarded as they are, whatever their encoding.
+type BodyTransform struct {
+	// ContentTypes defines the media types to transform, such as "text/html" or "text/*".
+	// Empty matches any content type.
+	ContentTypes []string
+	// Transformers defines the transformers chain, applied in order.
+	Transformers []BodyTransformer
+}
+
+// RequestTransform defines a body transform for the upstream requests.
+func RequestTransform(t BodyTransform) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.reqTransforms = append(f.httpForwarder.reqTransforms, t)
+		return nil
+	}
+}
+
+// ResponseTransform defines a body transform for the upstream responses.
+// The encodings accepted by the client are limited to the supported ones
+// when sent to the upstream server, so the responses can be transformed.
+func ResponseTransform(t BodyTransform) OptSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.resTransforms = append(f.httpForwarder.resTransforms, t)
+		return nil
+	}
+}
+
+// matches returns true if the transform applies to the given content type.
+func (t *BodyTransform) matches(contentType string) bool {
+	if len(t.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range t.ContentTypes {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType || pattern == "*/*" ||
+			strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformChain returns the transformers of the transforms matching the given content type.
+func transformChain(transforms []BodyTransform, contentType string) []BodyTransformer {
+	var chain []BodyTransformer
+	for _, t := range transforms {
+		if t.matches(contentType) {
+			chain = append(chain, t.Transformers...)
+		}
+	}
+	return chain
+}
+
+// checkRequestEncoding returns ErrUnsupportedEncoding if the given request body
+// matches a request transform, but uses an encoding that cannot be transformed.
+func (f *httpForwarder) checkRequestEncoding(req *http.Request) error {
+	if len(f.reqTransforms) == 0 || req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return nil
+	}
+	if len(transformChain(f.reqTransforms, req.Header.Get("Content-Type"))) > 0 && !supportedEncoding(contentEncoding(req.Header)) {
+		return ErrUnsupportedEncoding
+	}
+	return nil
+}
+
+// transformRequest applies the matching request transforms to the given upstream request body.
+// The transformed body is sent with unknown length.
+// Bodies using unsupported encodings must be rejected by checkRequestEncoding first.
+func (f *httpForwarder) transformRequest(req, outReq *http.Request) {
+	if len(f.reqTransforms) == 0 || outReq.Body == nil || outReq.Body == http.NoBody || outReq.ContentLength == 0 {
+		return
+	}
+	chain := transformChain(f.reqTransforms, outReq.Header.Get("Content-Type"))
+	encoding := contentEncoding(outReq.Header)
+	if len(chain) == 0 || !supportedEncoding(encoding) {
+		return
+	}
+	outReq.Body = transformBody(req, outReq.Body, encoding, chain)
+	outReq.ContentLength = -1
+	outReq.GetBody = nil
+	outReq.Header.Del(ContentLength)
+}
+
+// transformResponse applies the matching response transforms to the given upstream response body.
+// The transformed body is sent with unknown length, weakening the entity tag, if any.
+// It returns ErrUnsupportedEncoding if the matching response uses an encoding
+// that cannot be transformed.
+func (f *httpForwarder) transformResponse(req *http.Request, res *http.Response) error {
+	if len(f.resTransforms) == 0 || req.Method == "HEAD" || res.ContentLength == 0 ||
+		res.StatusCode == http.StatusPartialContent || !bodyAllowedForStatus(res.StatusCode) {
+		return nil
+	}
+	chain := transformChain(f.resTransforms, res.Header.Get("Content-Type"))
+	if len(chain) == 0 {
+		return nil
+	}
+	encoding := contentEncoding(res.Header)
+	if !supportedEncoding(encoding) {
+		return ErrUnsupportedEncoding
+	}
+	res.Body = transformBody(req, res.Body, encoding, chain)
+	res.ContentLength = -1
+	res.Header.Del(ContentLength)
+	res.Header.Del("Accept-Ranges")
+	if etag := res.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("Etag", "W/"+etag)
+	}
+	return nil
+}
+
+// limitAcceptEncoding limits the encodings accepted by the client to the supported ones,
+// falling back to identity if none is supported.
+func limitAcceptEncoding(h http.Header) {
+	if _, ok := h[AcceptEncoding]; !ok {
+		return
+	}
+	var accepted []string
+	for _, token := range headerTokens(h, AcceptEncoding) {
+		coding := strings.ToLower(strings.TrimSpace(strings.SplitN(token, ";", 2)[0]))
+		if coding == "identity" || supportedEncoding(coding) {
+			accepted = append(accepted, token)
+		}
+	}
+	if len(accepted) == 0 {
+		accepted = []string{"identity"}
+	}
+	h.Set(AcceptEncoding, strings.Join(accepted, ", "))
+}
+
+// contentEncoding returns the normalized content encoding of the given headers.
+func contentEncoding(h http.Header) string {
+	encoding := strings.ToLower(strings.Join(headerTokens(h, ContentEncoding), ","))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// supportedEncoding returns true if bodies using the given content encoding can be transformed.
+func supportedEncoding(encoding string) bool {
+	switch encoding {
+	case "", "gzip", "x-gzip", "deflate", "br":
+		return true
+	}
+	return false
+}
+
+// transformBody returns the given body transformed by the given chain.
+// Encoded bodies are decoded and encoded again while they are read.
+func transformBody(req *http.Request, body io.ReadCloser, encoding string, chain []BodyTransformer) io.ReadCloser {
+	if encoding == "" {
+		var r io.Reader = body
+		for _, t := range chain {
+			r = t.Transform(req, r)
+		}
+		return &readCloser{r, body}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		decoded, err := newDecoder(body, encoding)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		var r io.Reader = decoded
+		for _, t := range chain {
+			r = t.Transform(req, r)
+		}
+		encoder := newEncoder(pw, encoding)
+		if _, err = io.Copy(encoder, r); err == nil {
+			err = encoder.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return &transformedBody{pr, body}
+}
+
+// transformedBody closes both the pipe and the original body,
+// so the transforming goroutine exits when the body is no longer read.
+type transformedBody struct {
+	*io.PipeReader
+	body io.Closer
+}
+
+// Close closes the pipe and the original body.
+func (b *transformedBody) Close() error {
+	b.PipeReader.Close()
+	return b.body.Close()
+}
+
+// newDecoder returns a reader decoding the given body.
+// Deflate bodies are accepted both with and without the zlib wrapper.
+func newDecoder(body io.Reader, encoding string) (io.Reader, error) {
+	if encoding == "br" {
+		return brotli.NewReader(body), nil
+	}
+	if encoding == "deflate" {
+		br := bufio.NewReader(body)
+		if header, _ := br.Peek(2); len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	return gzip.NewReader(body)
+}
+
+// newEncoder returns a writer encoding the data written using the given encoding.
+func newEncoder(w io.Writer, encoding string) io.WriteCloser {
+	if encoding == "br" {
+		return brotli.NewWriter(w)
+	}
+	if encoding == "deflate" {
+		return zlib.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// Replace returns a transformer replacing every occurrence of old with new,
+// such as internal host names, without buffering the whole body.
+func Replace(old, new string) BodyTransformer {
+	return BodyTransformerFunc(func(req *http.Request, body io.Reader) io.Reader {
+		if old == "" {
+			return body
+		}
+		return &replaceReader{src: body, old: []byte(old), new: []byte(new)}
+	})
+}
+
+// replaceReader replaces the occurrences of old with new while reading,
+// keeping only the bytes that may start an occurrence split across reads.
+type replaceReader struct {
+	src      io.Reader
+	old, new []byte
+	chunk    []byte
+	pending  []byte
+	out      []byte
+	err      error
+}
+
+// Read reads the replaced data.
+func (r *replaceReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.chunk == nil {
+			r.chunk = make([]byte, 32*1024)
+		}
+		n, err := r.src.Read(r.chunk)
+		r.pending = append(r.pending, r.chunk[:n]...)
+		r.err = err
+		r.replace()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// replace moves the pending data to the output, replacing the occurrences found.
+func (r *replaceReader) replace() {
+	out := r.out[:0]
+	for {
+		i := bytes.Index(r.pending, r.old)
+		if i < 0 {
+			break
+		}
+		out = append(out, r.pending[:i]...)
+		out = append(out, r.new...)
+		r.pending = r.pending[i+len(r.old):]
+	}
+	// occurrences split across reads can only start within the last len(old)-1 bytes
+	keep := len(r.old) - 1
+	if r.err != nil {
+		keep = 0
+	}
+	if cut := len(r.pending) - keep; cut > 0 {
+		out = append(out, r.pending[:cut]...)
+		r.pending = r.pending[cut:]
+	}
+	r.out = out
+	r.pending = append([]byte(nil), r.pending...)
+}
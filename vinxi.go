@@ -92,8 +92,15 @@ func (v *Vinxi) Route(method, path string) *router.Route {
 }
 
 // Forward defines the default URL to forward incoming traffic.
-func (v *Vinxi) Forward(uri string) *Vinxi {
-	return v.UseFinalHandler(http.HandlerFunc(forward.To(uri)))
+// Options such as forward.StripPrefix can map the request paths onto the backend paths.
+func (v *Vinxi) Forward(uri string, opts ...forward.OptSetter) *Vinxi {
+	return v.UseFinalHandler(http.HandlerFunc(forward.To(uri, opts...)))
+}
+
+// ForwardMany balances the incoming traffic across the upstream servers of the given balancer.
+// Upstream servers can be added or removed from the balancer at runtime.
+func (v *Vinxi) ForwardMany(b *forward.Balancer) *Vinxi {
+	return v.UseFinalHandler(http.HandlerFunc(forward.ToMany(b)))
 }
 
 // Use attaches a new middleware handler for incoming HTTP traffic.
@@ -143,14 +150,14 @@ func (v *Vinxi) SetParent(parent layer.Middleware) {
 // NewServer creates a new http.Server.
 func (v *Vinxi) NewServer(opts ServerOptions) *Server {
 	srv := NewServer(opts)
-	v.BindServer(srv.Server)
+	srv.Vinxi = v
 	return srv
 }
 
 // ServeAndListen creates a new http.Server and starts listening on the network.
 func (v *Vinxi) ServeAndListen(opts ServerOptions) (*Server, error) {
 	srv := NewServer(opts)
-	v.BindServer(srv.Server)
+	srv.Vinxi = v
 	return srv, srv.Listen()
 }
 
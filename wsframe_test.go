@@ -0,0 +1,137 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nbio/st"
+	"github.com/vulcand/oxy/testutils"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebsocketFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 125, 300, 70000} {
+		for _, masked := range []bool{false, true} {
+			payload := bytes.Repeat([]byte("a"), size)
+			buf := &bytes.Buffer{}
+			st.Expect(t, writeFrame(buf, true, opBinary, payload, masked), nil)
+
+			fr, err := readFrame(bufio.NewReader(buf), DefaultMaxMessageSize)
+			st.Expect(t, err, nil)
+			st.Expect(t, fr.fin, true)
+			st.Expect(t, fr.opcode, opBinary)
+			st.Expect(t, bytes.Equal(fr.payload, payload), true)
+		}
+	}
+}
+
+func TestWebsocketFrameTooLarge(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeFrame(buf, true, opText, []byte("hello"), false)
+	_, err := readFrame(bufio.NewReader(buf), 4)
+	st.Expect(t, err, errMessageTooLarge)
+}
+
+func TestWebsocketFrameInvalidControl(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeFrame(buf, false, opPing, []byte("ping"), false)
+	_, err := readFrame(bufio.NewReader(buf), DefaultMaxMessageSize)
+	st.Reject(t, err, nil)
+}
+
+func TestMessageCopierFragmentation(t *testing.T) {
+	src := &bytes.Buffer{}
+	writeFrame(src, false, opText, []byte("hel"), true)
+	writeFrame(src, true, opPing, []byte("ping"), true)
+	writeFrame(src, true, opContinuation, []byte("lo"), true)
+	writeFrame(src, true, opBinary, []byte("drop"), true)
+
+	var messages []*Message
+	hook := MessageHookFunc(func(req *http.Request, msg *Message) (*Message, error) {
+		messages = append(messages, msg)
+		if msg.Type == BinaryMessage {
+			return nil, nil
+		}
+		return msg, nil
+	})
+
+	dst := &bytes.Buffer{}
+	c := &messageCopier{hooks: []MessageHook{hook}, direction: ClientToUpstream, maxSize: DefaultMaxMessageSize}
+	st.Expect(t, c.copy(dst, src), io.EOF)
+	st.Expect(t, len(messages), 2)
+	st.Expect(t, messages[0].Direction, ClientToUpstream)
+	st.Expect(t, string(messages[0].Data), "hello")
+
+	r := bufio.NewReader(dst)
+	fr, err := readFrame(r, DefaultMaxMessageSize)
+	st.Expect(t, err, nil)
+	st.Expect(t, fr.opcode, opPing)
+	fr, err = readFrame(r, DefaultMaxMessageSize)
+	st.Expect(t, err, nil)
+	st.Expect(t, fr.opcode, opText)
+	st.Expect(t, fr.fin, true)
+	st.Expect(t, string(fr.payload), "hello")
+	_, err = readFrame(r, DefaultMaxMessageSize)
+	st.Expect(t, err, io.EOF)
+}
+
+func TestMessageCopierUnexpectedContinuation(t *testing.T) {
+	src := &bytes.Buffer{}
+	writeFrame(src, true, opContinuation, []byte("lo"), false)
+	c := &messageCopier{direction: UpstreamToClient, maxSize: DefaultMaxMessageSize}
+	st.Reject(t, c.copy(&bytes.Buffer{}, src), io.EOF)
+}
+
+func TestWebsocketMessageHook(t *testing.T) {
+	var extensions string
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		extensions = conn.Request().Header.Get(SecWebsocketExtensions)
+		msg := make([]byte, 512)
+		for {
+			n, err := conn.Read(msg)
+			if err != nil {
+				return
+			}
+			conn.Write(msg[:n])
+		}
+	}))
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	hook := MessageHookFunc(func(req *http.Request, msg *Message) (*Message, error) {
+		if string(msg.Data) == "close" {
+			return nil, errors.New("closed by hook")
+		}
+		if msg.Direction == UpstreamToClient {
+			msg.Data = []byte(strings.ToUpper(string(msg.Data)))
+		}
+		return msg, nil
+	})
+	proxy := newTestProxy(t, srv.URL, WebsocketMessageHook(hook))
+	defer proxy.Close()
+
+	config, _ := websocket.NewConfig("ws://"+proxy.Listener.Addr().String()+"/ws", "http://localhost")
+	config.Header = http.Header{SecWebsocketExtensions: {"permessage-deflate"}}
+	conn, err := websocket.DialConfig(config)
+	st.Expect(t, err, nil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	st.Expect(t, err, nil)
+	msg := make([]byte, 5)
+	_, err = io.ReadFull(conn, msg)
+	st.Expect(t, err, nil)
+	st.Expect(t, string(msg), "HELLO")
+	st.Expect(t, extensions, "")
+
+	_, err = conn.Write([]byte("close"))
+	st.Expect(t, err, nil)
+	_, err = conn.Read(msg)
+	st.Reject(t, err, nil)
+}